@@ -0,0 +1,142 @@
+package tmi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Twitch's limit on the length of a chat message, in characters
+	maxChatLength = 500
+	// Channel that whispers were sent through with /w, see Whisper
+	whisperChannel = "#jtv"
+)
+
+var (
+	// ErrInvalidName is returned for channel or user names that are empty,
+	// or contain characters that would break the line sent to the server
+	ErrInvalidName = errors.New("invalid channel or user name")
+	// ErrNoChannel is returned when replying to a message that wasn't sent in a channel, like a whisper
+	ErrNoChannel = errors.New("message has no channel")
+)
+
+// Say sends a chat message to a channel.
+// Line breaks are replaced by spaces, and text over Twitch's 500 character limit
+// is split into several messages, on word boundaries where possible.
+func (tmi *Connection) Say(channel, text string) error {
+	channel, err := chatChannel(channel)
+	if err != nil {
+		return err
+	}
+	return tmi.say("", channel, text, "", "", maxChatLength)
+}
+
+// Action sends an action (/me) message to a channel, see Say
+func (tmi *Connection) Action(channel, text string) error {
+	channel, err := chatChannel(channel)
+	if err != nil {
+		return err
+	}
+	return tmi.say("", channel, text, actionPrefix, string(actionSuffix), maxChatLength)
+}
+
+// Reply answers a message in its channel, as a reply to it, see Say.
+// Messages without an id can't be replied to, so the reply is sent as a plain message.
+// Returns ErrNoChannel for messages that weren't sent in a channel.
+func (tmi *Connection) Reply(parent *Message, text string) error {
+	channel := parent.Channel()
+	if !strings.HasPrefix(channel, "#") || !validName(channel[1:]) {
+		return ErrNoChannel
+	}
+	tags := ""
+	if id := parent.Tag("id"); id != "" {
+		tags = "@reply-parent-msg-id=" + EscapeTag(id) + " "
+	}
+	return tmi.say(tags, channel, text, "", "", maxChatLength)
+}
+
+// Whisper sends a private message to a user with the /w chat command, see Say.
+// Twitch stopped accepting chat commands over IRC in February 2023, so servers that follow
+// that only answer with a NOTICE and the whisper isn't delivered.
+// Whispers are sent with the Helix API's Send Whisper endpoint instead, which this package doesn't cover.
+func (tmi *Connection) Whisper(user, text string) error {
+	user = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(user), "@"))
+	if !validName(user) {
+		return ErrInvalidName
+	}
+	// The command counts towards the length of the message
+	command := "/w " + user + " "
+	return tmi.say("", whisperChannel, text, command, "", maxChatLength-utf8.RuneCountInString(command))
+}
+
+// Part leaves a channel, it won't be joined again when reconnecting
+func (tmi *Connection) Part(channel string) error {
+	channel, err := chatChannel(channel)
+	if err != nil {
+		return err
+	}
+	return tmi.SendContext(context.Background(), "PART "+channel)
+}
+
+// Send text as one or more PRIVMSGs of at most max characters, each part wrapped in before and after
+func (tmi *Connection) say(tags, channel, text, before, after string, max int) error {
+	for _, part := range splitText(stripLines(text), max) {
+		if err := tmi.SendContext(context.Background(), tags+"PRIVMSG "+channel+" :"+before+part+after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Normalise a channel name, rejecting names that would inject something into the line
+func chatChannel(channel string) (string, error) {
+	channel = normalizeChannel(channel)
+	if !validName(channel[1:]) {
+		return "", ErrInvalidName
+	}
+	return channel, nil
+}
+
+// Names can't be empty, or contain separators or line breaks
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " ,\r\n\x00")
+}
+
+// Replace line breaks, which would otherwise end the line and start a new command
+func stripLines(text string) string {
+	if strings.IndexAny(text, "\r\n") < 0 {
+		return text
+	}
+	return strings.Join(strings.FieldsFunc(text, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+}
+
+// Split text into parts of at most max characters, breaking at the last space in each part if there is one
+func splitText(text string, max int) []string {
+	text = strings.TrimSpace(text)
+	var parts []string
+	for utf8.RuneCountInString(text) > max {
+		// Byte offset of the first character that doesn't fit
+		cut, n := 0, 0
+		for i := range text {
+			if n == max {
+				cut = i
+				break
+			}
+			n++
+		}
+		end := cut
+		if text[cut] != ' ' {
+			if i := strings.LastIndexByte(text[:cut], ' '); i > 0 {
+				end = i
+			}
+		}
+		parts = append(parts, strings.TrimSpace(text[:end]))
+		text = strings.TrimSpace(text[end:])
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
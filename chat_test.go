@@ -0,0 +1,131 @@
+package tmi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// A stopped connection, collecting what would be sent
+func collectConnection() (*Connection, *[]string) {
+	conn := New("sunsbot", "")
+	var sent []string
+	conn.UseOutgoing(func(m *Message, err error) (*Message, error) {
+		sent = append(sent, string(m.BytesWithTags()))
+		return nil, nil
+	})
+	return conn, &sent
+}
+
+func TestChatHelpers(t *testing.T) {
+	conn, sent := collectConnection()
+	conn.Say("Sunspots", "hello\r\nPRIVMSG #other :injected")
+	conn.Action("#sunspots", "waves")
+	conn.Reply(ParseMessage("@id=b34ccfc7 :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :hi"), "hey")
+	conn.Reply(ParseMessage(":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :hi"), "hey")
+	conn.Whisper("@Sunspots", "psst")
+	conn.Part(" #SunSpots ")
+
+	expected := []string{
+		"PRIVMSG #sunspots :hello PRIVMSG #other :injected",
+		"PRIVMSG #sunspots :\x01ACTION waves\x01",
+		"@reply-parent-msg-id=b34ccfc7 PRIVMSG #sunspots :hey",
+		"PRIVMSG #sunspots :hey",
+		"PRIVMSG #jtv :/w sunspots psst",
+		"PART #sunspots",
+	}
+	if !reflect.DeepEqual(*sent, expected) {
+		t.Errorf("Expected %q, got %q", expected, *sent)
+	}
+}
+
+func TestChatHelpersInvalid(t *testing.T) {
+	conn, sent := collectConnection()
+	for name, err := range map[string]error{
+		"say":           conn.Say("chan\r\nPART #x", "hi"),
+		"say empty":     conn.Say(" # ", "hi"),
+		"say comma":     conn.Say("#a,#b", "hi"),
+		"action":        conn.Action("chan\nJOIN #evil", "hi"),
+		"part":          conn.Part("chan PRIVMSG #x :hi"),
+		"whisper":       conn.Whisper("bob\r\nJOIN #evil", "hi"),
+		"whisper space": conn.Whisper("bob JOIN", "hi"),
+		"whisper empty": conn.Whisper("@", "hi"),
+	} {
+		if err != ErrInvalidName {
+			t.Errorf("%s: expected ErrInvalidName, got %v", name, err)
+		}
+	}
+	whisper := ParseMessage("@message-id=1 :sunspots!sunspots@sunspots.tmi.twitch.tv WHISPER sunsbot :psst")
+	if err := conn.Reply(whisper, "hey"); err != ErrNoChannel {
+		t.Errorf("Expected ErrNoChannel replying to a whisper, got %v", err)
+	}
+	if len(*sent) != 0 {
+		t.Errorf("Expected nothing to be sent, got %q", *sent)
+	}
+}
+
+func TestWhisperLength(t *testing.T) {
+	conn, sent := collectConnection()
+	conn.Whisper("sunspots", strings.Repeat("a", 1000))
+	if len(*sent) != 3 {
+		t.Fatalf("Expected 3 whispers, got %d", len(*sent))
+	}
+	for _, line := range *sent {
+		text := strings.TrimPrefix(line, "PRIVMSG #jtv :")
+		if n := utf8.RuneCountInString(text); n > maxChatLength || !strings.HasPrefix(text, "/w sunspots a") {
+			t.Errorf("Unexpected whisper of %d characters: %q", n, text)
+		}
+	}
+}
+
+func TestReplyRateLimit(t *testing.T) {
+	conn, server := pipeConnection(t, func(conn *Connection) {
+		conn.RateLimits = &Limits{User: RateLimit{Messages: 1, Per: time.Hour}}
+	})
+	defer conn.Disconnect()
+	parent := ParseMessage("@id=b34ccfc7 :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :hi")
+	for i := 0; i < 3; i++ {
+		if err := conn.Reply(parent, "hey"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.expect(t, "@reply-parent-msg-id=b34ccfc7 PRIVMSG #sunspots :hey")
+	select {
+	case line := <-server.lines:
+		if strings.Contains(line, "PRIVMSG") {
+			t.Errorf("Replied above the rate limit: %q", line)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	word := strings.Repeat("é", 9) + " " // 10 characters, 19 bytes
+	long := strings.Repeat(word, 120)
+	parts := splitText(long, maxChatLength)
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d", len(parts))
+	}
+	for _, part := range parts {
+		if n := utf8.RuneCountInString(part); n > maxChatLength || !utf8.ValidString(part) {
+			t.Errorf("Invalid part of %d characters", n)
+		}
+		if strings.HasPrefix(part, " ") || strings.HasSuffix(part, " ") || !strings.HasSuffix(part, "é") {
+			t.Errorf("Expected the part to be split on a word boundary: %q", part)
+		}
+	}
+	if strings.Join(parts, " ") != strings.TrimSpace(long) {
+		t.Error("Expected the parts to make up the text")
+	}
+
+	// Words longer than the limit are cut
+	parts = splitText(strings.Repeat("a", 1200), maxChatLength)
+	if len(parts) != 3 || len(parts[0]) != 500 || len(parts[2]) != 200 {
+		t.Errorf("Unexpected parts of %d", len(parts))
+	}
+	if parts := splitText("  ", maxChatLength); len(parts) != 0 {
+		t.Errorf("Expected no parts, got %q", parts)
+	}
+}
@@ -0,0 +1,88 @@
+package tmi
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// Cheer is a single cheermote in a message, ex. Cheer100.
+// Like Emote, From and To are code point positions with To inclusive,
+// and Trailing[Start:End] is the cheer's text.
+type Cheer struct {
+	Prefix string `json:"prefix"` // Cheermote prefix, ex. Cheer or PogChamp
+	Amount int    `json:"amount"`
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+}
+
+// ParseCheers is a short way to parse and save the message's cheers, using tmi.ParseCheers.
+// Only messages with a bits tag have cheers.
+func (m *Message) ParseCheers() {
+	if m == nil || m.Tag("bits") == "" {
+		return
+	}
+	m.Cheers = ParseCheers(m.Trailing)
+}
+
+// TotalBits sums up the amounts of the message's cheers.
+// It should match the bits tag, which is the authoritative total.
+func (m *Message) TotalBits() int {
+	total := 0
+	for _, c := range m.Cheers {
+		total += c.Amount
+	}
+	return total
+}
+
+// ParseCheers finds the cheermotes in a text, words made of a prefix followed by an amount,
+// ex. Cheer100, PogChamp500 or 4Head100. Since any such word looks like a cheer, only use it
+// on messages that actually contain bits, see Message.ParseCheers.
+func ParseCheers(text string) []*Cheer {
+	var cheers []*Cheer
+	runes := 0
+	for start := 0; start < len(text); {
+		// Find the next word
+		if text[start] == space {
+			start++
+			runes++
+			continue
+		}
+		end := start
+		for end < len(text) && text[end] != space {
+			end++
+		}
+		word := text[start:end]
+		if c := parseCheer(word); c != nil {
+			c.Start, c.End = start, end
+			c.From, c.To = runes, runes+len(word)-1 // Cheers are ASCII, one byte per rune
+			cheers = append(cheers, c)
+		}
+		runes += utf8.RuneCountInString(word)
+		start = end
+	}
+	return cheers
+}
+
+// Parse a single word as a cheer, nil if it isn't one.
+// The amount is the trailing run of digits, the prefix may contain digits too, ex. 4Head100.
+func parseCheer(word string) *Cheer {
+	i := len(word)
+	for i > 0 && word[i-1] >= '0' && word[i-1] <= '9' {
+		i--
+	}
+	if i == 0 || i == len(word) || word[i] == '0' {
+		return nil
+	}
+	for j := 0; j < i; j++ {
+		if c := word[j]; !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return nil
+		}
+	}
+	amount, err := strconv.Atoi(word[i:])
+	if err != nil {
+		return nil
+	}
+	return &Cheer{Prefix: word[:i], Amount: amount}
+}
@@ -0,0 +1,54 @@
+package tmi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCheers(t *testing.T) {
+	m := ParseMessage("@bits=650;emotes=25:27-31 :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :Cheer100 héllo PogChamp500 Kappa cheer50 abc Cheer0 Cheer1x")
+	m.ParseEmotes()
+	m.ParseCheers()
+	expected := []*Cheer{
+		{Prefix: "Cheer", Amount: 100, From: 0, To: 7, Start: 0, End: 8},
+		{Prefix: "PogChamp", Amount: 500, From: 15, To: 25, Start: 16, End: 27},
+		{Prefix: "cheer", Amount: 50, From: 33, To: 39, Start: 34, End: 41},
+	}
+	if !reflect.DeepEqual(m.Cheers, expected) {
+		t.Errorf("Unexpected cheers %+v", m.Cheers)
+	}
+	if m.TotalBits() != 650 {
+		t.Errorf("Expected 650 bits, got %d", m.TotalBits())
+	}
+
+	fragments := []Fragment{
+		{Text: "Cheer100", Cheer: m.Cheers[0]},
+		{Text: " héllo "},
+		{Text: "PogChamp500", Cheer: m.Cheers[1]},
+		{Text: " "},
+		{Text: "Kappa", Emote: m.Emotes[0]},
+		{Text: " "},
+		{Text: "cheer50", Cheer: m.Cheers[2]},
+		{Text: " abc Cheer0 Cheer1x"},
+	}
+	if !reflect.DeepEqual(m.Fragments(), fragments) {
+		t.Errorf("Unexpected fragments %+v", m.Fragments())
+	}
+
+	// Prefixes may contain digits, the amount is the trailing run of digits
+	cheers := ParseCheers("4Head100 1000 4Head Cheer-5 4Head05 Party2Go10")
+	expected = []*Cheer{
+		{Prefix: "4Head", Amount: 100, From: 0, To: 7, Start: 0, End: 8},
+		{Prefix: "Party2Go", Amount: 10, From: 36, To: 45, Start: 36, End: 46},
+	}
+	if !reflect.DeepEqual(cheers, expected) {
+		t.Errorf("Unexpected cheers %+v", cheers)
+	}
+
+	// No bits, no cheers
+	m = ParseMessage(":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :Cheer100")
+	m.ParseCheers()
+	if m.Cheers != nil {
+		t.Errorf("Unexpected cheers %+v", m.Cheers)
+	}
+}
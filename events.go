@@ -0,0 +1,298 @@
+package tmi
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User holds the details Twitch sends about the user behind a message
+type User struct {
+	ID          string `json:"id"`           // user-id
+	Name        string `json:"name"`         // Login name
+	DisplayName string `json:"display_name"` // Display name, may differ from Name in more than case
+	Color       string `json:"color"`        // Hex color, ex. #FF6BFF, empty if the user never set one
+	Mod         bool   `json:"mod"`
+	Subscriber  bool   `json:"subscriber"`
+	Turbo       bool   `json:"turbo"`
+	Type        string `json:"type"` // user-type, ex. mod, global_mod, admin or staff
+}
+
+// PrivateMessage is a chat message in a channel (PRIVMSG)
+type PrivateMessage struct {
+	*Message
+	Channel string
+	User    User
+	Text    string
+	ID      string    // Message id, used for replies and deleting the message
+	RoomID  string    // Channel id
+	Bits    int       // Amount of bits cheered, 0 if none
+	First   bool      // First message of the user in the channel
+	Time    time.Time // Time the server sent the message
+
+	ReplyParentMsgID string // Id of the message this is a reply to, empty if it isn't a reply
+}
+
+// UserNotice is a notice about a user event, like a sub, resub, raid or ritual (USERNOTICE)
+type UserNotice struct {
+	*Message
+	Channel   string
+	User      User
+	Text      string // Message the user added, may be empty
+	SystemMsg string // Message describing the event, ex. "Sunspots subscribed for 3 months"
+	MsgID     string // Type of event, ex. sub, resub, subgift, raid or ritual
+	ID        string
+	RoomID    string
+	Time      time.Time
+	MsgParams map[string]string // msg-param-* tags, without the msg-param- prefix
+}
+
+// MsgParamInt returns a msg-param as an int, ex. MsgParamInt("cumulative-months")
+func (n *UserNotice) MsgParamInt(name string) int {
+	i, _ := strconv.Atoi(n.MsgParams[name])
+	return i
+}
+
+// ClearChat is sent when a user is banned or timed out, or the whole chat is cleared (CLEARCHAT)
+type ClearChat struct {
+	*Message
+	Channel     string
+	Target      string        // Login of the banned or timed out user, empty if the chat was cleared
+	TargetID    string        // User id of Target
+	BanDuration time.Duration // Length of a timeout, 0 for permanent bans
+	RoomID      string
+	Time        time.Time
+}
+
+// ClearMsg is sent when a single message is deleted (CLEARMSG)
+type ClearMsg struct {
+	*Message
+	Channel     string
+	Login       string // Login of the user who sent the message
+	Text        string // The deleted message
+	TargetMsgID string // Id of the deleted message
+	Time        time.Time
+}
+
+// RoomState holds a channel's chat settings (ROOMSTATE).
+// Only the settings that changed are sent after joining, see Message.LookupTag to tell which.
+type RoomState struct {
+	*Message
+	Channel               string
+	RoomID                string
+	EmoteOnly             bool
+	FollowersOnly         bool
+	FollowersOnlyDuration time.Duration // How long users must have followed to chat
+	R9K                   bool          // Unique chat mode
+	Slow                  time.Duration // Time users must wait between messages, 0 if slow mode is off
+	SubsOnly              bool
+}
+
+// UserState is our own state in a channel, sent when joining it and after sending a message (USERSTATE)
+type UserState struct {
+	*Message
+	Channel   string
+	User      User
+	EmoteSets []string
+}
+
+// GlobalUserState is our own state after logging in (GLOBALUSERSTATE)
+type GlobalUserState struct {
+	*Message
+	User      User
+	EmoteSets []string
+}
+
+// Whisper is a private message between two users (WHISPER)
+type Whisper struct {
+	*Message
+	User      User   // The sender
+	To        string // Login of the recipient
+	Text      string
+	MessageID string
+	ThreadID  string
+}
+
+// HostTarget is sent when a channel starts or stops hosting another channel (HOSTTARGET)
+type HostTarget struct {
+	*Message
+	Channel string
+	Target  string // Hosted channel, empty when hosting stops
+	Viewers int
+}
+
+// Notice is a message from the server, ex. about a failed command (NOTICE)
+type Notice struct {
+	*Message
+	Channel string // Empty for notices not about a channel, like failed logins
+	MsgID   string
+	Text    string
+}
+
+// Typed converts the message to the matching event struct, ex. *PrivateMessage for a PRIVMSG.
+// Other commands return the message itself, so the result can be used in a type switch.
+func (m *Message) Typed() interface{} {
+	switch m.Command {
+	case "PRIVMSG":
+		return &PrivateMessage{
+			Message:          m,
+			Channel:          m.Channel(),
+			User:             m.user(),
+			Text:             m.Trailing,
+			ID:               m.Tag("id"),
+			RoomID:           m.Tag("room-id"),
+			Bits:             m.tagInt("bits"),
+			First:            m.tagBool("first-msg"),
+			Time:             m.tagTime("tmi-sent-ts"),
+			ReplyParentMsgID: m.Tag("reply-parent-msg-id"),
+		}
+	case "USERNOTICE":
+		n := &UserNotice{
+			Message:   m,
+			Channel:   m.Channel(),
+			User:      m.user(),
+			Text:      m.Trailing,
+			SystemMsg: m.Tag("system-msg"),
+			MsgID:     m.Tag("msg-id"),
+			ID:        m.Tag("id"),
+			RoomID:    m.Tag("room-id"),
+			Time:      m.tagTime("tmi-sent-ts"),
+			MsgParams: make(map[string]string),
+		}
+		m.LoadTags()
+		for k, v := range m.Tags {
+			if strings.HasPrefix(k, "msg-param-") {
+				n.MsgParams[k[len("msg-param-"):]] = v
+			}
+		}
+		return n
+	case "CLEARCHAT":
+		return &ClearChat{
+			Message:     m,
+			Channel:     m.Channel(),
+			Target:      m.Trailing,
+			TargetID:    m.Tag("target-user-id"),
+			BanDuration: m.tagSeconds("ban-duration"),
+			RoomID:      m.Tag("room-id"),
+			Time:        m.tagTime("tmi-sent-ts"),
+		}
+	case "CLEARMSG":
+		return &ClearMsg{
+			Message:     m,
+			Channel:     m.Channel(),
+			Login:       m.Tag("login"),
+			Text:        m.Trailing,
+			TargetMsgID: m.Tag("target-msg-id"),
+			Time:        m.tagTime("tmi-sent-ts"),
+		}
+	case "ROOMSTATE":
+		r := &RoomState{
+			Message:   m,
+			Channel:   m.Channel(),
+			RoomID:    m.Tag("room-id"),
+			EmoteOnly: m.tagBool("emote-only"),
+			R9K:       m.tagBool("r9k"),
+			Slow:      m.tagSeconds("slow"),
+			SubsOnly:  m.tagBool("subs-only"),
+		}
+		// followers-only is -1 when off, otherwise the number of minutes
+		if _, ok := m.LookupTag("followers-only"); ok && m.tagInt("followers-only") >= 0 {
+			r.FollowersOnly = true
+			r.FollowersOnlyDuration = time.Duration(m.tagInt("followers-only")) * time.Minute
+		}
+		return r
+	case "USERSTATE":
+		return &UserState{
+			Message:   m,
+			Channel:   m.Channel(),
+			User:      m.user(),
+			EmoteSets: m.tagList("emote-sets"),
+		}
+	case "GLOBALUSERSTATE":
+		return &GlobalUserState{
+			Message:   m,
+			User:      m.user(),
+			EmoteSets: m.tagList("emote-sets"),
+		}
+	case "WHISPER":
+		w := &Whisper{
+			Message:   m,
+			User:      m.user(),
+			Text:      m.Trailing,
+			MessageID: m.Tag("message-id"),
+			ThreadID:  m.Tag("thread-id"),
+		}
+		if len(m.Params) > 0 {
+			w.To = m.Params[0]
+		}
+		return w
+	case "HOSTTARGET":
+		// :tmi.twitch.tv HOSTTARGET #sunspots :sunsbot 12
+		h := &HostTarget{Message: m, Channel: m.Channel()}
+		fields := strings.Fields(m.Trailing)
+		if len(fields) > 0 && fields[0] != "-" {
+			h.Target = fields[0]
+		}
+		if len(fields) > 1 {
+			h.Viewers, _ = strconv.Atoi(fields[1])
+		}
+		return h
+	case "NOTICE":
+		return &Notice{
+			Message: m,
+			Channel: m.Channel(),
+			MsgID:   m.Tag("msg-id"),
+			Text:    m.Trailing,
+		}
+	}
+	return m
+}
+
+// The user details from the message's tags and prefix
+func (m *Message) user() User {
+	u := User{
+		ID:          m.Tag("user-id"),
+		Name:        m.Tag("login"),
+		DisplayName: m.Tag("display-name"),
+		Color:       m.Tag("color"),
+		Mod:         m.tagBool("mod"),
+		Subscriber:  m.tagBool("subscriber"),
+		Turbo:       m.tagBool("turbo"),
+		Type:        m.Tag("user-type"),
+	}
+	if u.Name == "" {
+		// Empty for the server's prefix
+		u.Name = m.Prefix.Nick
+	}
+	return u
+}
+
+func (m *Message) tagInt(key string) int {
+	i, _ := strconv.Atoi(m.Tag(key))
+	return i
+}
+
+func (m *Message) tagBool(key string) bool {
+	return m.Tag(key) == "1"
+}
+
+// Durations are sent in seconds
+func (m *Message) tagSeconds(key string) time.Duration {
+	return time.Duration(m.tagInt(key)) * time.Second
+}
+
+// Times are sent as unix timestamps in milliseconds
+func (m *Message) tagTime(key string) time.Time {
+	ms, err := strconv.ParseInt(m.Tag(key), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func (m *Message) tagList(key string) []string {
+	if m.Tag(key) == "" {
+		return nil
+	}
+	return strings.Split(m.Tag(key), ",")
+}
@@ -0,0 +1,94 @@
+package tmi
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTyped(t *testing.T) {
+	privmsg := ParseMessage("@badge-info=;badges=broadcaster/1;bits=100;color=#FF6BFF;display-name=Sunspots;first-msg=1;id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;mod=0;room-id=1337;subscriber=0;tmi-sent-ts=1507246572675;turbo=1;user-id=1337;user-type= :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :cheer100 hi")
+	p, ok := privmsg.Typed().(*PrivateMessage)
+	if !ok {
+		t.Fatalf("expected a *PrivateMessage, got %T", privmsg.Typed())
+	}
+	expected := &PrivateMessage{
+		Message: privmsg,
+		Channel: "#sunspots",
+		User: User{
+			ID:          "1337",
+			Name:        "sunspots",
+			DisplayName: "Sunspots",
+			Color:       "#FF6BFF",
+			Turbo:       true,
+		},
+		Text:   "cheer100 hi",
+		ID:     "b34ccfc7-4977-403a-8a94-33c6bac34fb8",
+		RoomID: "1337",
+		Bits:   100,
+		First:  true,
+		Time:   time.UnixMilli(1507246572675),
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("unexpected PrivateMessage %+v", p)
+	}
+
+	notice := ParseMessage("@display-name=Sunsbot;login=sunsbot;msg-id=resub;msg-param-cumulative-months=6;msg-param-sub-plan=Prime;system-msg=Sunsbot\\ssubscribed\\swith\\sTwitch\\sPrime.;tmi-sent-ts=1507246572675 :tmi.twitch.tv USERNOTICE #sunspots :Great stream!").Typed().(*UserNotice)
+	if notice.User.Name != "sunsbot" || notice.MsgID != "resub" || notice.SystemMsg != "Sunsbot subscribed with Twitch Prime." ||
+		notice.MsgParamInt("cumulative-months") != 6 || notice.MsgParams["sub-plan"] != "Prime" || notice.Text != "Great stream!" {
+		t.Errorf("unexpected UserNotice %+v", notice)
+	}
+
+	clear := ParseMessage("@ban-duration=600;room-id=1337;target-user-id=42;tmi-sent-ts=1507246572675 :tmi.twitch.tv CLEARCHAT #sunspots :sunsbot").Typed().(*ClearChat)
+	if clear.Target != "sunsbot" || clear.TargetID != "42" || clear.BanDuration != 10*time.Minute {
+		t.Errorf("unexpected ClearChat %+v", clear)
+	}
+	if clear := ParseMessage(":tmi.twitch.tv CLEARCHAT #sunspots").Typed().(*ClearChat); clear.Target != "" || clear.BanDuration != 0 {
+		t.Errorf("unexpected ClearChat %+v", clear)
+	}
+
+	msg := ParseMessage("@login=sunsbot;target-msg-id=abc :tmi.twitch.tv CLEARMSG #sunspots :oops").Typed().(*ClearMsg)
+	if msg.Login != "sunsbot" || msg.TargetMsgID != "abc" || msg.Text != "oops" {
+		t.Errorf("unexpected ClearMsg %+v", msg)
+	}
+
+	room := ParseMessage("@emote-only=0;followers-only=10;r9k=1;room-id=1337;slow=30;subs-only=0 :tmi.twitch.tv ROOMSTATE #sunspots").Typed().(*RoomState)
+	if !room.FollowersOnly || room.FollowersOnlyDuration != 10*time.Minute || !room.R9K || room.Slow != 30*time.Second || room.EmoteOnly || room.SubsOnly {
+		t.Errorf("unexpected RoomState %+v", room)
+	}
+	if room := ParseMessage("@followers-only=-1 :tmi.twitch.tv ROOMSTATE #sunspots").Typed().(*RoomState); room.FollowersOnly {
+		t.Errorf("unexpected RoomState %+v", room)
+	}
+
+	state := ParseMessage("@color=;display-name=Sunsbot;emote-sets=0,33,50;mod=1;subscriber=0;user-type=mod :tmi.twitch.tv USERSTATE #sunspots").Typed().(*UserState)
+	if !state.User.Mod || state.User.Name != "" || !reflect.DeepEqual(state.EmoteSets, []string{"0", "33", "50"}) {
+		t.Errorf("unexpected UserState %+v", state)
+	}
+
+	global := ParseMessage("@display-name=Sunsbot;emote-sets=0;user-id=42 :tmi.twitch.tv GLOBALUSERSTATE").Typed().(*GlobalUserState)
+	if global.User.ID != "42" || !reflect.DeepEqual(global.EmoteSets, []string{"0"}) {
+		t.Errorf("unexpected GlobalUserState %+v", global)
+	}
+
+	whisper := ParseMessage("@display-name=Sunspots;message-id=1;thread-id=42_1337 :sunspots!sunspots@sunspots.tmi.twitch.tv WHISPER sunsbot :psst").Typed().(*Whisper)
+	if whisper.User.Name != "sunspots" || whisper.To != "sunsbot" || whisper.Text != "psst" || whisper.ThreadID != "42_1337" {
+		t.Errorf("unexpected Whisper %+v", whisper)
+	}
+
+	host := ParseMessage(":tmi.twitch.tv HOSTTARGET #sunspots :sunsbot 12").Typed().(*HostTarget)
+	if host.Target != "sunsbot" || host.Viewers != 12 {
+		t.Errorf("unexpected HostTarget %+v", host)
+	}
+	if host := ParseMessage(":tmi.twitch.tv HOSTTARGET #sunspots :- 0").Typed().(*HostTarget); host.Target != "" {
+		t.Errorf("unexpected HostTarget %+v", host)
+	}
+
+	n := ParseMessage("@msg-id=slow_on :tmi.twitch.tv NOTICE #sunspots :This room is now in slow mode.").Typed().(*Notice)
+	if n.Channel != "#sunspots" || n.MsgID != "slow_on" {
+		t.Errorf("unexpected Notice %+v", n)
+	}
+
+	if m := ParseMessage(":tmi.twitch.tv RECONNECT"); m.Typed() != m {
+		t.Errorf("expected the message itself, got %T", m.Typed())
+	}
+}
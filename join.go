@@ -0,0 +1,244 @@
+package tmi
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrChannelSuspended is the result of joining a channel that has been suspended
+	ErrChannelSuspended = errors.New("channel is suspended")
+
+	// NOTICE msg-ids the server answers a failed JOIN with
+	joinErrors = map[string]error{
+		"msg_channel_suspended": ErrChannelSuspended,
+	}
+)
+
+// JoinResult is the outcome of joining a single channel
+type JoinResult struct {
+	Channel string
+	Err     error
+}
+
+// joinQueue batches channels waiting to be joined, and keeps track of
+// the callers waiting for the server to answer
+type joinQueue struct {
+	sync.Mutex
+	pending []string
+	waiting map[string][]chan JoinResult
+	wake    chan bool
+}
+
+func newJoinQueue() *joinQueue {
+	return &joinQueue{
+		waiting: make(map[string][]chan JoinResult),
+		wake:    make(chan bool, 1),
+	}
+}
+
+// Queue channels for joining, with an optional channel receiving each result
+func (q *joinQueue) add(channels []string, result chan JoinResult) {
+	q.Lock()
+	for _, channel := range channels {
+		if result != nil {
+			q.waiting[channel] = append(q.waiting[channel], result)
+		}
+		q.pending = append(q.pending, channel)
+	}
+	q.Unlock()
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// Report the server's answer for a channel to everyone waiting on it
+func (q *joinQueue) done(channel string, err error) {
+	q.Lock()
+	waiting := q.waiting[channel]
+	delete(q.waiting, channel)
+	q.Unlock()
+	for _, result := range waiting {
+		result <- JoinResult{Channel: channel, Err: err}
+	}
+}
+
+// Stop reporting answers for the channels to result, ex. when the caller gave up waiting
+func (q *joinQueue) forget(channels []string, result chan JoinResult) {
+	q.Lock()
+	defer q.Unlock()
+	for _, channel := range channels {
+		waiting := q.waiting[channel][:0]
+		for _, r := range q.waiting[channel] {
+			if r != result {
+				waiting = append(waiting, r)
+			}
+		}
+		if len(waiting) == 0 {
+			delete(q.waiting, channel)
+		} else {
+			q.waiting[channel] = waiting
+		}
+	}
+}
+
+// Join queues a channel for joining. Joins are sent in batches,
+// within the JOIN rate limit, see Connection.RateLimits
+func (tmi *Connection) Join(channel string) {
+	tmi.joins.add([]string{normalizeChannel(channel)}, nil)
+}
+
+// JoinAll queues channels for joining, and waits until the server has
+// confirmed or rejected each of them, or ctx is done.
+// Channels the server rejects aren't rejoined when reconnecting.
+func (tmi *Connection) JoinAll(ctx context.Context, channels ...string) []JoinResult {
+	results := make([]JoinResult, len(channels))
+	pending := make(map[string]bool, len(channels))
+	var queue []string
+	for i, channel := range channels {
+		channel = normalizeChannel(channel)
+		results[i].Channel = channel
+		if !pending[channel] {
+			pending[channel] = true
+			queue = append(queue, channel)
+		}
+	}
+
+	tmi.Lock()
+	end := tmi.end
+	tmi.Unlock()
+	errs := make(map[string]error, len(queue))
+	answers := make(chan JoinResult, len(queue))
+	tmi.joins.add(queue, answers)
+	// The server never answers for channels that don't exist
+	defer tmi.joins.forget(queue, answers)
+	for len(pending) > 0 {
+		var err error
+		select {
+		case answer := <-answers:
+			errs[answer.Channel] = answer.Err
+			delete(pending, answer.Channel)
+			continue
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-end:
+			err = ErrStopped
+		}
+		for channel := range pending {
+			errs[channel] = err
+		}
+		break
+	}
+	for i := range results {
+		results[i].Err = errs[results[i].Channel]
+	}
+	return results
+}
+
+// The joinloop sends queued joins in batches, within the JOIN rate limit
+func (tmi *Connection) joinLoop() {
+	defer tmi.Done()
+	// A new Connect replaces these once the connection is stopped
+	tmi.Lock()
+	end, ctx := tmi.end, tmi.ctx
+	tmi.Unlock()
+	for {
+		select {
+		case <-tmi.joins.wake:
+		case <-end:
+			return
+		}
+		for {
+			tmi.joins.Lock()
+			pending := tmi.joins.pending
+			tmi.joins.Unlock()
+			if len(pending) == 0 {
+				break
+			}
+			n, ok := tmi.reserveJoins(ctx, pending)
+			if !ok {
+				return
+			}
+			tmi.joins.Lock()
+			tmi.joins.pending = tmi.joins.pending[n:]
+			tmi.joins.Unlock()
+			tmi.Send("JOIN " + strings.Join(pending[:n], ","))
+		}
+	}
+}
+
+// Join the tracked channels on a new session, in batches within the JOIN rate limit
+func (tmi *Connection) rejoin(ctx context.Context, s *session) error {
+	tmi.Lock()
+	channels := make([]string, 0, len(tmi.channels))
+	for channel := range tmi.channels {
+		channels = append(channels, channel)
+	}
+	tmi.Unlock()
+	sort.Strings(channels)
+
+	s.Lock()
+	for _, channel := range channels {
+		s.joining[channel] = true
+	}
+	if len(s.joining) == 0 {
+		close(s.ready)
+	}
+	s.Unlock()
+
+	for len(channels) > 0 {
+		n, ok := tmi.reserveJoins(ctx, channels)
+		if !ok {
+			return ctx.Err()
+		}
+		if err := tmi.write(s, "JOIN "+strings.Join(channels[:n], ",")); err != nil {
+			return err
+		}
+		channels = channels[n:]
+	}
+	return nil
+}
+
+// Wait until at least one of the channels can be joined, and return how many
+// of them to put in the next JOIN. Returns false if ctx is done while waiting.
+func (tmi *Connection) reserveJoins(ctx context.Context, channels []string) (int, bool) {
+	// Fit as many channels as possible in a single line
+	max, length := 0, len("JOIN ")
+	for _, channel := range channels {
+		if length+len(channel) > maxLength && max > 0 {
+			break
+		}
+		length += len(channel) + 1
+		max++
+	}
+	if tmi.limiter == nil {
+		return max, true
+	}
+	for {
+		n, wait := tmi.limiter.reserveJoins(max, time.Now())
+		if n > 0 {
+			return n, true
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, false
+		}
+	}
+}
+
+// Normalise a channel name to the lowercase, #-prefixed form the server uses
+func normalizeChannel(channel string) string {
+	channel = strings.ToLower(strings.TrimSpace(channel))
+	if !strings.HasPrefix(channel, "#") {
+		channel = "#" + channel
+	}
+	return channel
+}
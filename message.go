@@ -5,6 +5,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
@@ -26,14 +27,25 @@ const (
 
 // Emote struct for storing one emote, with a single from/to position.
 // Storing each emote occurance in one object allows us to properly sort the emotes
-// to ease the
+// to ease the replacement of emotes in the message's text, see Message.Fragments.
+// From and To are the code point (rune) positions Twitch sends, To being inclusive.
+// Start and End are the byte offsets in Message.Trailing, so Trailing[Start:End] is the emote's text.
 type Emote struct {
 	ID     string `json:"id"`
 	From   int    `json:"from"`
 	To     int    `json:"to"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
 	Source string `json:"source"` // Source is used to allow parsing and inserting more emotes, ex. from BTTV
 }
 
+// Fragment is a part of a message's text, either plain text, a single emote or a single cheer
+type Fragment struct {
+	Text  string `json:"text"`
+	Emote *Emote `json:"emote,omitempty"` // The emote, nil for plain text
+	Cheer *Cheer `json:"cheer,omitempty"` // The cheer, nil for plain text
+}
+
 //ByPos is a sorting interface for Emotes
 type ByPos []*Emote
 
@@ -41,15 +53,113 @@ func (a ByPos) Len() int           { return len(a) }
 func (a ByPos) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByPos) Less(i, j int) bool { return a[i].From < a[j].From }
 
+// Prefix is the source of a message, nick!user@host for users and just the host for the server
+type Prefix struct {
+	Nick string `json:"nick,omitempty"`
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+// ParsePrefix parses a message prefix, without the leading colon.
+// A prefix without nick or user, like tmi.twitch.tv, is the server's host.
+func ParsePrefix(s string) Prefix {
+	var p Prefix
+	if i := strings.IndexByte(s, prefixTags); i >= 0 {
+		s, p.Host = s[:i], s[i+1:]
+	} else if strings.IndexByte(s, prefixUser) < 0 && strings.IndexByte(s, '.') >= 0 {
+		p.Host = s
+		return p
+	}
+	if i := strings.IndexByte(s, prefixUser); i >= 0 {
+		s, p.User = s[:i], s[i+1:]
+	}
+	p.Nick = s
+	return p
+}
+
+// String returns the prefix in its raw form, without the leading colon
+func (p Prefix) String() string {
+	s := p.Nick
+	if p.User != "" {
+		s += string(prefixUser) + p.User
+	}
+	if p.Host != "" {
+		if s == "" {
+			return p.Host
+		}
+		s += string(prefixTags) + p.Host
+	}
+	return s
+}
+
+// IsServer tells if the prefix is the server's, rather than a user's
+func (p Prefix) IsServer() bool {
+	return p.Nick == "" && p.Host != ""
+}
+
+// IsAnonymous tells if the prefix is an anonymous justinfan user, see Anonymous
+func (p Prefix) IsAnonymous() bool {
+	return strings.HasPrefix(p.Nick, "justinfan")
+}
+
 // Message struct contains all the relevant data for a message
 type Message struct {
 	From     string            `json:"from"`
+	Prefix   Prefix            `json:"prefix"`
 	Command  string            `json:"command"`
 	Params   []string          `json:"params"`
 	Trailing string            `json:"trailing"`
 	Tags     map[string]string `json:"tags"`
 	Emotes   []*Emote          `json:"emotes"`
+	Cheers   []*Cheer          `json:"cheers,omitempty"`
 	Action   bool              `json:"action,omitempty"`
+
+	rawTags string // Tags not parsed yet, see ParseMessageInto
+}
+
+// Tag returns the value of a tag, parsing only that tag if the tags haven't been parsed yet
+func (m *Message) Tag(key string) string {
+	v, _ := m.LookupTag(key)
+	return v
+}
+
+// LookupTag returns the value of a tag, and wether the message has it
+func (m *Message) LookupTag(key string) (string, bool) {
+	if m.rawTags == "" {
+		v, ok := m.Tags[key]
+		return v, ok
+	}
+	s := m.rawTags
+	for len(s) > 0 {
+		tag := s
+		if i := strings.IndexByte(s, tagSep); i >= 0 {
+			tag, s = s[:i], s[i+1:]
+		} else {
+			s = ""
+		}
+		if !strings.HasPrefix(tag, key) {
+			continue
+		}
+		if len(tag) == len(key) {
+			return "", true
+		}
+		if tag[len(key)] == tagAss {
+			return UnescapeTag(tag[len(key)+1:]), true
+		}
+	}
+	return "", false
+}
+
+// LoadTags parses the tags into Message.Tags, if they were left for later by ParseMessageInto
+func (m *Message) LoadTags() {
+	if m.rawTags == "" {
+		return
+	}
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	parseTags(m.Tags, m.rawTags)
+	m.rawTags = ""
 }
 
 // ParseEmotes is a short way to automatically parse and save the message's emotes, using tmi.ParseEmotes
@@ -57,48 +167,260 @@ func (m *Message) ParseEmotes() {
 	if m == nil {
 		return
 	}
-	if m.Tags != nil {
-		s, ok := m.Tags["emotes"]
-		if !ok {
-			return
+	s, ok := m.LookupTag("emotes")
+	if !ok {
+		return
+	}
+	m.Emotes = ParseEmotes(s)
+	sort.Sort(ByPos(m.Emotes))
+	SetEmoteOffsets(m.Trailing, m.Emotes)
+}
+
+// SetEmoteOffsets sets the byte offsets Start and End of the emotes in text, from their code point positions.
+// Positions outside of the text are clamped to its end.
+func SetEmoteOffsets(text string, emotes []*Emote) {
+	if len(emotes) == 0 {
+		return
+	}
+	// Byte offset of each rune, and of the end of the text
+	offsets := make([]int, 0, len(text)+1)
+	for i := range text {
+		offsets = append(offsets, i)
+	}
+	offsets = append(offsets, len(text))
+	offset := func(pos int) int {
+		if pos < 0 {
+			return 0
+		}
+		if pos >= len(offsets) {
+			return len(text)
+		}
+		return offsets[pos]
+	}
+	for _, e := range emotes {
+		e.Start = offset(e.From)
+		e.End = offset(e.To + 1)
+		if e.End < e.Start {
+			e.End = e.Start
 		}
-		m.Emotes = ParseEmotes(s)
-		sort.Sort(ByPos(m.Emotes))
 	}
 }
 
+// Fragments splits the message's text into plain text, emote and cheer fragments, in order.
+// Uses Message.Emotes and Message.Cheers if set, otherwise the emotes and bits tags.
+// Overlapping emotes and cheers are skipped.
+func (m *Message) Fragments() []Fragment {
+	emotes := m.Emotes
+	if emotes == nil {
+		emotes = ParseEmotes(m.Tag("emotes"))
+		SetEmoteOffsets(m.Trailing, emotes)
+	}
+	cheers := m.Cheers
+	if cheers == nil && m.Tag("bits") != "" {
+		cheers = ParseCheers(m.Trailing)
+	}
+
+	type span struct {
+		start, end int
+		fragment   Fragment
+	}
+	spans := make([]span, 0, len(emotes)+len(cheers))
+	for _, e := range emotes {
+		spans = append(spans, span{e.Start, e.End, Fragment{Emote: e}})
+	}
+	for _, c := range cheers {
+		spans = append(spans, span{c.Start, c.End, Fragment{Cheer: c}})
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var fragments []Fragment
+	position := 0
+	for _, s := range spans {
+		if s.start < position || s.end <= s.start || s.end > len(m.Trailing) {
+			continue
+		}
+		if s.start > position {
+			fragments = append(fragments, Fragment{Text: m.Trailing[position:s.start]})
+		}
+		s.fragment.Text = m.Trailing[s.start:s.end]
+		fragments = append(fragments, s.fragment)
+		position = s.end
+	}
+	if position < len(m.Trailing) {
+		fragments = append(fragments, Fragment{Text: m.Trailing[position:]})
+	}
+	return fragments
+}
+
 // Bytes is used to return a Message to a []byte, in case we want to send a *Message to the server
 // This does not return a parsed Message to its original form, but rather a message
-// in the basic form that the server expects
+// in the basic form that the server expects, without tags. See Message.BytesWithTags.
 func (m *Message) Bytes() []byte {
 	var buf bytes.Buffer
+	m.write(&buf, false, false)
+	if buf.Len() > maxLength {
+		buf.Truncate(maxLength)
+	}
+	return buf.Bytes()
+}
+
+// BytesWithTags is like Message.Bytes, but includes the tags, escaped and sorted by key.
+// Used to send tags like reply-parent-msg-id or client-only tags like +client-nonce,
+// so clear the Tags of a received message before sending it back.
+// It isn't truncated, Twitch limits chat messages in characters rather than bytes.
+func (m *Message) BytesWithTags() []byte {
+	var buf bytes.Buffer
+	m.write(&buf, true, false)
+	return buf.Bytes()
+}
+
+// String returns a stringified version of the message, see Message.Bytes.
+// Without the tags and prefix it doesn't round trip, use Message.Raw for that.
+func (m *Message) String() string {
+	return string(m.Bytes())
+}
+
+// Raw returns the message in its full raw form, with tags and prefix, without truncating it.
+// Parsing the result with ParseMessage gives back the same Message.
+func (m *Message) Raw() string {
+	var buf bytes.Buffer
+	m.write(&buf, true, true)
+	return buf.String()
+}
+
+// Write the message in its raw form, optionally with the tags, sorted by key, and the prefix
+func (m *Message) write(buf *bytes.Buffer, withTags, withPrefix bool) {
+	if withTags {
+		m.writeTags(buf)
+	}
+	if withPrefix && (m.Prefix != Prefix{} || m.From != "") {
+		buf.WriteByte(prefix)
+		if m.Prefix != (Prefix{}) {
+			buf.WriteString(m.Prefix.String())
+		} else {
+			buf.WriteString(m.From)
+		}
+		buf.WriteByte(space)
+	}
 
 	buf.WriteString(m.Command)
 
 	if len(m.Params) > 0 {
 		buf.WriteByte(space)
 		buf.WriteString(strings.Join(m.Params, string(space)))
-		if len(m.Trailing) > 0 {
-			buf.WriteByte(space)
-			buf.WriteByte(prefix)
+	}
+	if len(m.Trailing) > 0 || m.Action {
+		buf.WriteByte(space)
+		buf.WriteByte(prefix)
+		if m.Action {
+			buf.WriteString(actionPrefix)
+			buf.WriteString(m.Trailing)
+			buf.WriteByte(actionSuffix)
+		} else {
 			buf.WriteString(m.Trailing)
 		}
 	}
-	if buf.Len() > (maxLength) {
-		buf.Truncate(maxLength)
+}
+
+// Write the tags section, if there are any tags
+func (m *Message) writeTags(buf *bytes.Buffer) {
+	if m.rawTags != "" {
+		// Still escaped as received
+		buf.WriteByte(prefixTags)
+		buf.WriteString(m.rawTags)
+		buf.WriteByte(space)
+		return
 	}
-	return buf.Bytes()
+	if len(m.Tags) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf.WriteByte(prefixTags)
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(tagSep)
+		}
+		buf.WriteString(k)
+		if v := m.Tags[k]; v != "" {
+			buf.WriteByte(tagAss)
+			buf.WriteString(EscapeTag(v))
+		}
+	}
+	buf.WriteByte(space)
 }
 
-// String returns a stringified version of the message, see Message.Bytes
-func (m *Message) String() string {
-	return string(m.Bytes())
+// Badges returns the badges from the badges tag, mapping each badge to its version,
+// ex. badges=broadcaster/1,subscriber/12 gives {"broadcaster": "1", "subscriber": "12"}
+func (m *Message) Badges() map[string]string {
+	return parseBadges(m.Tag("badges"))
+}
+
+// BadgeInfo returns the extra badge details from the badge-info tag,
+// ex. badge-info=subscriber/14 gives {"subscriber": "14"}, the exact number of months subscribed
+func (m *Message) BadgeInfo() map[string]string {
+	return parseBadges(m.Tag("badge-info"))
+}
+
+// IsModerator tells if the message's user is a moderator in the channel
+func (m *Message) IsModerator() bool {
+	return m.Tag("mod") == "1" || m.hasBadge("moderator")
+}
+
+// IsBroadcaster tells if the message's user is the channel's broadcaster
+func (m *Message) IsBroadcaster() bool {
+	return m.hasBadge("broadcaster")
+}
+
+// IsVIP tells if the message's user is a VIP in the channel
+func (m *Message) IsVIP() bool {
+	return m.Tag("vip") == "1" || m.hasBadge("vip")
+}
+
+// IsSubscriber tells if the message's user is subscribed to the channel
+func (m *Message) IsSubscriber() bool {
+	return m.Tag("subscriber") == "1" || m.hasBadge("subscriber") || m.hasBadge("founder")
+}
+
+// SubscriberMonths returns the number of months the message's user has been subscribed, 0 if unknown
+func (m *Message) SubscriberMonths() int {
+	info := m.BadgeInfo()
+	months, ok := info["subscriber"]
+	if !ok {
+		months = info["founder"]
+	}
+	n, _ := strconv.Atoi(months)
+	return n
+}
+
+func (m *Message) hasBadge(name string) bool {
+	_, ok := m.Badges()[name]
+	return ok
+}
+
+// Parse a badges or badge-info tag, ex. broadcaster/1,subscriber/12
+func parseBadges(s string) map[string]string {
+	badges := make(map[string]string)
+	if s == "" {
+		return badges
+	}
+	for _, badge := range strings.Split(s, ",") {
+		if i := strings.IndexByte(badge, '/'); i >= 0 {
+			badges[badge[:i]] = badge[i+1:]
+		} else if badge != "" {
+			badges[badge] = ""
+		}
+	}
+	return badges
 }
 
 // Channel is a simple method to get the channel, aka the first param
 func (m *Message) Channel() string {
 	if len(m.Params) > 0 {
-		if m.Params[0][0] == '#' {
+		if strings.HasPrefix(m.Params[0], "#") {
 			return m.Params[0]
 		}
 	}
@@ -107,11 +429,51 @@ func (m *Message) Channel() string {
 
 // ParseMessage parses a message from a raw string into a *Message
 func ParseMessage(raw string) *Message {
+	m := new(Message)
+	if !parseMessage(m, raw, false) {
+		return nil
+	}
+	return m
+}
+
+// ParseMessageInto parses a message from a raw string into m, reusing its memory,
+// ex. a Message from AcquireMessage. Returns false if raw isn't a message.
+// Tags are parsed lazily, use Message.Tag or Message.LoadTags to read them.
+func ParseMessageInto(m *Message, raw string) bool {
+	return parseMessage(m, raw, true)
+}
+
+var messagePool = sync.Pool{
+	New: func() interface{} { return new(Message) },
+}
+
+// AcquireMessage returns an empty Message from a pool, to parse into with ParseMessageInto
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// ReleaseMessage returns a Message to the pool. The message, and any
+// strings or slices taken from it, must not be used afterwards.
+func ReleaseMessage(m *Message) {
+	m.reset()
+	messagePool.Put(m)
+}
+
+// Empty the message, keeping the memory of the params and tags for reuse
+func (m *Message) reset() {
+	for k := range m.Tags {
+		delete(m.Tags, k)
+	}
+	*m = Message{Params: m.Params[:0], Tags: m.Tags}
+}
+
+// Parse raw into m, the tags are kept as a raw string if lazy
+func parseMessage(m *Message, raw string, lazy bool) bool {
+	m.reset()
 	raw = strings.TrimSpace(raw)
 	if len(raw) < 1 {
-		return nil
+		return false
 	}
-	m := new(Message)
 
 	// Next delimiter, before the next part we want to parse (i)
 	// nextDelimiter is always relative to the current position, so actual index
@@ -122,26 +484,30 @@ func ParseMessage(raw string) *Message {
 
 	//Extract tags
 	if raw[0] == prefixTags {
-		// If tags are indicated, but no space after (no command), return nil
+		// If tags are indicated, but no space after (no command), return false
 		if nextDelimiter = strings.IndexByte(raw, space); nextDelimiter < 0 {
-			return nil
+			return false
+		}
+		if lazy {
+			m.rawTags = raw[1:nextDelimiter]
+		} else {
+			m.Tags = ParseTags(raw[1:nextDelimiter])
 		}
-		m.Tags = ParseTags(raw[1:nextDelimiter])
 		position += nextDelimiter + 1
 	}
 
-	// Extract and sipmlify prefix as "From";
+	// Extract the prefix, and simplify it as "From";
 	// since all twitch users have generic host/nick (user!user@user.tmi.twitch.tv)
-	// We only really need a single "from", instead of breaking it up to save arbitrary data
-	// Only possible use case would be if we explicitly need to know if a message
-	// was sent from a user or if it was sent from server
+	// a single "from" is all most uses need. The full prefix is kept in Prefix,
+	// ex. to know if a message was sent from a user or if it was sent from server
 	if raw[position] == prefix {
-		// If prefix is indicated but no space after (command is missing), return nil
-		if nextDelimiter = strings.IndexByte(raw[position:], space); position+nextDelimiter < 0 {
-			return nil
+		// If prefix is indicated but no space after (command is missing), return false
+		if nextDelimiter = strings.IndexByte(raw[position:], space); nextDelimiter < 0 {
+			return false
 		}
 
 		m.From = raw[position+1 : position+nextDelimiter]
+		m.Prefix = ParsePrefix(m.From)
 
 		if a := strings.IndexByte(m.From, prefixUser); a != -1 {
 			m.From = m.From[0:a]
@@ -155,7 +521,7 @@ func ParseMessage(raw string) *Message {
 	if nextDelimiter < 0 {
 		// Nothing after command, return
 		m.Command = raw[position:]
-		return m
+		return true
 	}
 	m.Command = raw[position : position+nextDelimiter]
 	position += nextDelimiter + 1
@@ -163,26 +529,38 @@ func ParseMessage(raw string) *Message {
 	// Find prefix for trailing
 	nextDelimiter = strings.IndexByte(raw[position:], prefix)
 
-	var params []string
 	if nextDelimiter < 0 {
 		//no trailing
-		params = strings.Split(raw[position:], string(space))
+		m.Params = splitParams(m.Params, raw[position:])
 	} else {
 		// Has trailing
 		if nextDelimiter > 0 {
 			// Has params
-			params = strings.Split(raw[position:position+nextDelimiter-1], string(space))
+			m.Params = splitParams(m.Params, raw[position:position+nextDelimiter-1])
 		}
 		m.Trailing = raw[position+nextDelimiter+1:]
 	}
-	if len(params) > 0 {
-		m.Params = params
+	if len(m.Params) == 0 && !lazy {
+		m.Params = nil
+	}
+	cleanMessage(m)
+	return true
+}
+
+// Append the space separated params in s to params
+func splitParams(params []string, s string) []string {
+	for {
+		i := strings.IndexByte(s, space)
+		if i < 0 {
+			return append(params, s)
+		}
+		params = append(params, s[:i])
+		s = s[i+1:]
 	}
-	return cleanMessage(m)
 }
 
 // Do some default normalising and cleaning
-func cleanMessage(m *Message) *Message {
+func cleanMessage(m *Message) {
 	if m.Command == "PRIVMSG" {
 		//Normalise ACTION(/me) on PRIVMSGs
 		tLen := len(m.Trailing)
@@ -193,51 +571,145 @@ func cleanMessage(m *Message) *Message {
 			}
 		}
 	}
-	return m
 }
 
 // ParseEmotes transform the emotes string from the tag and returns a slice
 // containing individual *Emote instances for each emote occurance.
 func ParseEmotes(emoteString string) []*Emote {
-	emotes := []*Emote{}
 	if emoteString == "" {
 		return nil
 	}
-	emoteSplit := strings.Split(emoteString, "/")
-	var occuranceSplit []string
-	var split []string
-	var id string
-	for _, e := range emoteSplit {
-		split = strings.Split(e, ":")
-		id = split[0]
-		occuranceSplit = strings.Split(split[1], ",")
+	emotes, _, _ := parseEmotes(emoteString)
+	return emotes
+}
 
-		for _, o := range occuranceSplit {
-			i := strings.IndexByte(o, emSep)
-			from, _ := strconv.Atoi(o[:i])
-			to, _ := strconv.Atoi(o[i+1:])
-			emotes = append(emotes, &Emote{ID: id, From: from, To: to, Source: "twitch"})
+// Parse an emotes tag, skipping malformed emotes.
+// The first malformed one is reported with its position in s.
+func parseEmotes(s string) ([]*Emote, int, error) {
+	emotes := []*Emote{}
+	var errPos int
+	var err error
+	fail := func(pos int, e error) {
+		if err == nil {
+			errPos, err = pos, e
 		}
 	}
-	return emotes
+	position := 0
+	for _, e := range strings.Split(s, "/") {
+		i := strings.IndexByte(e, ':')
+		if i <= 0 {
+			fail(position, ErrMalformedEmotes)
+			position += len(e) + 1
+			continue
+		}
+		id := e[:i]
+		occurance := position + i + 1
+		for _, o := range strings.Split(e[i+1:], ",") {
+			dash := strings.IndexByte(o, emSep)
+			if dash < 0 {
+				fail(occurance, ErrMalformedEmotes)
+				occurance += len(o) + 1
+				continue
+			}
+			from, err1 := strconv.Atoi(o[:dash])
+			to, err2 := strconv.Atoi(o[dash+1:])
+			if err1 != nil || err2 != nil || from < 0 || to < from {
+				fail(occurance, ErrMalformedEmotes)
+			} else {
+				emotes = append(emotes, &Emote{ID: id, From: from, To: to, Source: "twitch"})
+			}
+			occurance += len(o) + 1
+		}
+		position += len(e) + 1
+	}
+	return emotes, errPos, err
 }
 
-// ParseTags turns the tag prefix string into a proper map[string]string
+// ParseTags turns the tag prefix string into a proper map[string]string,
+// unescaping the values, see UnescapeTag
 func ParseTags(s string) map[string]string {
 	result := make(map[string]string)
+	parseTags(result, s)
+	return result
+}
 
-	c, i, i2 := 0, 0, 0 // text cursor and indexes
-	for {
-		i = strings.IndexByte(s[c:], tagSep) // i = end of command, i2 = equal-sign
-		if i > 0 {
-			i2 = strings.IndexByte(s[c:c+i], tagAss)
-			result[s[c:c+i2]] = s[c+i2+1 : c+i]
-			c += i + 1
+func parseTags(result map[string]string, s string) {
+	for len(s) > 0 {
+		tag := s
+		if i := strings.IndexByte(s, tagSep); i >= 0 {
+			tag, s = s[:i], s[i+1:]
 		} else {
-			i2 = strings.IndexByte(s[c:], tagAss)
-			result[s[c:c+i2]] = s[c+i2+1:]
+			s = ""
+		}
+		if tag == "" {
+			continue
+		}
+		// Tags without a value, or with an empty one, are both stored as ""
+		if i := strings.IndexByte(tag, tagAss); i >= 0 {
+			result[tag[:i]] = UnescapeTag(tag[i+1:])
+		} else {
+			result[tag] = ""
+		}
+	}
+}
+
+// UnescapeTag unescapes an IRCv3 tag value.
+// \: is a semicolon, \s a space, \\ a backslash and \r, \n are CR and LF.
+// Any other escaped character is kept as is, and a trailing lone backslash is dropped.
+func UnescapeTag(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+	var b strings.Builder
+	b.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(value) {
 			break
 		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(space)
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
 	}
-	return result
+	return b.String()
+}
+
+// EscapeTag escapes a tag value for sending, the reverse of UnescapeTag
+func EscapeTag(value string) string {
+	if strings.IndexAny(value, "; \\\r\n") < 0 {
+		return value
+	}
+	var b strings.Builder
+	b.Grow(len(value) + 8)
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case ';':
+			b.WriteString("\\:")
+		case space:
+			b.WriteString("\\s")
+		case '\\':
+			b.WriteString("\\\\")
+		case '\r':
+			b.WriteString("\\r")
+		case '\n':
+			b.WriteString("\\n")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
 }
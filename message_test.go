@@ -2,6 +2,7 @@ package tmi
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -9,12 +10,14 @@ var testMessages = map[string]*Message{
 	// Message with prefix, command and one argument
 	":sunsbot!sunsbot@sunsbot.tmi.twitch.tv JOIN #sunspots": &Message{
 		From:    "sunsbot",
+		Prefix:  Prefix{Nick: "sunsbot", User: "sunsbot", Host: "sunsbot.tmi.twitch.tv"},
 		Command: "JOIN",
 		Params:  []string{"#sunspots"},
 	},
 	// PRIVMSG message
 	":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :test message, lol": &Message{
 		From:     "sunspots",
+		Prefix:   Prefix{Nick: "sunspots", User: "sunspots", Host: "sunspots.tmi.twitch.tv"},
 		Command:  "PRIVMSG",
 		Params:   []string{"#sunspots"},
 		Trailing: "test message, lol",
@@ -22,6 +25,7 @@ var testMessages = map[string]*Message{
 	// Message with tags
 	"@color=#FF6BFF;emotes=;subscriber=0;turbo=0;user-type= :sunsbot!sunsbot@sunsbot.tmi.twitch.tv PRIVMSG #sunspots :test message, lol": &Message{
 		From:     "sunsbot",
+		Prefix:   Prefix{Nick: "sunsbot", User: "sunsbot", Host: "sunsbot.tmi.twitch.tv"},
 		Command:  "PRIVMSG",
 		Params:   []string{"#sunspots"},
 		Trailing: "test message, lol",
@@ -36,6 +40,7 @@ var testMessages = map[string]*Message{
 	// Message with tags, by broadcaster
 	"@color=#FF6BFF;emotes=;subscriber=0;turbo=0;user-type= :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :test message, lol": &Message{
 		From:     "sunspots",
+		Prefix:   Prefix{Nick: "sunspots", User: "sunspots", Host: "sunspots.tmi.twitch.tv"},
 		Command:  "PRIVMSG",
 		Params:   []string{"#sunspots"},
 		Trailing: "test message, lol",
@@ -50,6 +55,7 @@ var testMessages = map[string]*Message{
 	// Message with ACTION
 	"@color=#FF6BFF;emotes=;subscriber=0;turbo=0;user-type= :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :\001ACTION likes pie\001": &Message{
 		From:     "sunspots",
+		Prefix:   Prefix{Nick: "sunspots", User: "sunspots", Host: "sunspots.tmi.twitch.tv"},
 		Command:  "PRIVMSG",
 		Params:   []string{"#sunspots"},
 		Trailing: "likes pie",
@@ -65,6 +71,7 @@ var testMessages = map[string]*Message{
 	// Message with emotes
 	"@color=#FF6BFF;display-name=Sunspots;emotes=25:0-4/1902:12-16/30259:23-29,31-37;subscriber=0;turbo=0;user-type= :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :Kappa Hello Keepo test HeyGuys HeyGuys": &Message{
 		From:     "sunspots",
+		Prefix:   Prefix{Nick: "sunspots", User: "sunspots", Host: "sunspots.tmi.twitch.tv"},
 		Command:  "PRIVMSG",
 		Params:   []string{"#sunspots"},
 		Trailing: "Kappa Hello Keepo test HeyGuys HeyGuys",
@@ -77,20 +84,21 @@ var testMessages = map[string]*Message{
 			"user-type":    "",
 		},
 		Emotes: []*Emote{
-			&Emote{ID: "25", From: 0, To: 4, Source: "twitch"},
-			&Emote{ID: "1902", From: 12, To: 16, Source: "twitch"},
-			&Emote{ID: "30259", From: 23, To: 29, Source: "twitch"},
-			&Emote{ID: "30259", From: 31, To: 37, Source: "twitch"},
+			&Emote{ID: "25", From: 0, To: 4, Start: 0, End: 5, Source: "twitch"},
+			&Emote{ID: "1902", From: 12, To: 16, Start: 12, End: 17, Source: "twitch"},
+			&Emote{ID: "30259", From: 23, To: 29, Start: 23, End: 30, Source: "twitch"},
+			&Emote{ID: "30259", From: 31, To: 37, Start: 31, End: 38, Source: "twitch"},
 		},
 	},
 	// Message with escaped spaces in tags
 	"@color=#8A2BE2;display-name=Sparklingsandshrew\\s\\s;emotes=;subscriber=0;turbo=0;user-type= :sparklingsandshrew!sparklingsandshrew@sparklingsandshrew.tmi.twitch.tv PRIVMSG #sunspots :Hello!": &Message{
 		From:     "sparklingsandshrew",
+		Prefix:   Prefix{Nick: "sparklingsandshrew", User: "sparklingsandshrew", Host: "sparklingsandshrew.tmi.twitch.tv"},
 		Command:  "PRIVMSG",
 		Params:   []string{"#sunspots"},
 		Trailing: "Hello!",
 		Tags: map[string]string{
-			"display-name": "Sparklingsandshrew\\s\\s",
+			"display-name": "Sparklingsandshrew  ",
 			"color":        "#8A2BE2",
 			"emotes":       "",
 			"subscriber":   "0",
@@ -98,9 +106,27 @@ var testMessages = map[string]*Message{
 			"user-type":    "",
 		},
 	},
+	// Message with badges and badge info
+	"@badge-info=subscriber/14;badges=moderator/1,subscriber/12;color=;display-name=Sunsbot;mod=1;subscriber=1;user-type=mod :sunsbot!sunsbot@sunsbot.tmi.twitch.tv PRIVMSG #sunspots :hi": &Message{
+		From:     "sunsbot",
+		Prefix:   Prefix{Nick: "sunsbot", User: "sunsbot", Host: "sunsbot.tmi.twitch.tv"},
+		Command:  "PRIVMSG",
+		Params:   []string{"#sunspots"},
+		Trailing: "hi",
+		Tags: map[string]string{
+			"badge-info":   "subscriber/14",
+			"badges":       "moderator/1,subscriber/12",
+			"color":        "",
+			"display-name": "Sunsbot",
+			"mod":          "1",
+			"subscriber":   "1",
+			"user-type":    "mod",
+		},
+	},
 	// Message with no params but with trailing
 	":sunspots!sunspots@sunspots.tmi.twitch.tv QUIT :Went somewhere else": &Message{
 		From:     "sunspots",
+		Prefix:   Prefix{Nick: "sunspots", User: "sunspots", Host: "sunspots.tmi.twitch.tv"},
 		Command:  "QUIT",
 		Trailing: "Went somewhere else",
 	},
@@ -108,6 +134,7 @@ var testMessages = map[string]*Message{
 	":tmi.twitch.tv RECONNECT": &Message{
 		Command: "RECONNECT",
 		From:    "tmi.twitch.tv",
+		Prefix:  Prefix{Host: "tmi.twitch.tv"},
 	},
 	// Message with command only
 	"RECONNECT": &Message{
@@ -168,6 +195,132 @@ func TestParseMessage(t *testing.T) {
 	}
 
 }
+
+// String doesn't include the tags and prefix, Raw is the form that round trips
+func TestMessageRaw(t *testing.T) {
+	for raw, p := range testMessages {
+		if p == nil {
+			continue
+		}
+		m := ParseMessage(p.Raw())
+		if m != nil {
+			m.ParseEmotes()
+		}
+		if !reflect.DeepEqual(m, p) {
+			t.Errorf("Message \"%s\" didn't survive a round trip, got \"%s\"", raw, p.Raw())
+		}
+	}
+
+	// Long messages aren't truncated
+	raw := "@id=1 :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :" + strings.Repeat("é", 400)
+	if s := ParseMessage(raw).Raw(); s != raw {
+		t.Errorf("Long message didn't survive a round trip, got %d bytes instead of %d", len(s), len(raw))
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	m := &Message{
+		From:     "sunsbot",
+		Command:  "PRIVMSG",
+		Params:   []string{"#sunspots"},
+		Trailing: "hi there",
+		Tags: map[string]string{
+			"reply-parent-msg-id": "b34ccfc7-4977-403a-8a94-33c6bac34fb8",
+			"+client-nonce":       "a b;c",
+		},
+	}
+	expected := "@+client-nonce=a\\sb\\:c;reply-parent-msg-id=b34ccfc7-4977-403a-8a94-33c6bac34fb8 PRIVMSG #sunspots :hi there"
+	if s := string(m.BytesWithTags()); s != expected {
+		t.Errorf("Unexpected bytes %q", s)
+	}
+	// Tags are only sent when asked for
+	if s := string(m.Bytes()); s != "PRIVMSG #sunspots :hi there" || m.String() != s {
+		t.Errorf("Unexpected bytes without tags %q", s)
+	}
+	raw := "@+client-nonce=a\\sb\\:c;reply-parent-msg-id=b34ccfc7-4977-403a-8a94-33c6bac34fb8 :sunsbot PRIVMSG #sunspots :hi there"
+	if s := m.Raw(); s != raw {
+		t.Errorf("Unexpected raw message %q", s)
+	}
+}
+
+// Expected badges and helper results for messages in testMessages
+var testBadges = map[string]struct {
+	badges, info                            map[string]string
+	moderator, broadcaster, vip, subscriber bool
+	months                                  int
+}{
+	"@badge-info=subscriber/14;badges=moderator/1,subscriber/12;color=;display-name=Sunsbot;mod=1;subscriber=1;user-type=mod :sunsbot!sunsbot@sunsbot.tmi.twitch.tv PRIVMSG #sunspots :hi": {
+		badges:     map[string]string{"moderator": "1", "subscriber": "12"},
+		info:       map[string]string{"subscriber": "14"},
+		moderator:  true,
+		subscriber: true,
+		months:     14,
+	},
+	"@color=#FF6BFF;emotes=;subscriber=0;turbo=0;user-type= :sunsbot!sunsbot@sunsbot.tmi.twitch.tv PRIVMSG #sunspots :test message, lol": {
+		badges: map[string]string{},
+		info:   map[string]string{},
+	},
+	":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :test message, lol": {
+		badges: map[string]string{},
+		info:   map[string]string{},
+	},
+	"@badge-info=founder/3;badges=broadcaster/1,vip/1,founder/0 :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :hi": {
+		badges:      map[string]string{"broadcaster": "1", "vip": "1", "founder": "0"},
+		info:        map[string]string{"founder": "3"},
+		broadcaster: true,
+		vip:         true,
+		subscriber:  true,
+		months:      3,
+	},
+}
+
+func TestBadges(t *testing.T) {
+	for raw, b := range testBadges {
+		m := ParseMessage(raw)
+		if !reflect.DeepEqual(m.Badges(), b.badges) {
+			t.Errorf("Unexpected badges %v for \"%s\"", m.Badges(), raw)
+		}
+		if !reflect.DeepEqual(m.BadgeInfo(), b.info) {
+			t.Errorf("Unexpected badge info %v for \"%s\"", m.BadgeInfo(), raw)
+		}
+		if m.IsModerator() != b.moderator || m.IsBroadcaster() != b.broadcaster || m.IsVIP() != b.vip ||
+			m.IsSubscriber() != b.subscriber || m.SubscriberMonths() != b.months {
+			t.Errorf("Unexpected badge helpers for \"%s\"", raw)
+		}
+	}
+}
+
+func TestEmoteOffsets(t *testing.T) {
+	// Emoji and non-ASCII text before, between and after the emotes
+	m := ParseMessage("@emotes=25:3-7,17-21 :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :\U0001F600\u00e9 Kappa h\u00e9ll\u00f8 \U0001F44B Kappa!")
+	m.ParseEmotes()
+	for _, e := range m.Emotes {
+		if text := m.Trailing[e.Start:e.End]; text != "Kappa" {
+			t.Errorf("Emote at %d-%d is %q, expected Kappa", e.From, e.To, text)
+		}
+	}
+	expected := []Fragment{
+		{Text: "\U0001F600\u00e9 "},
+		{Text: "Kappa", Emote: m.Emotes[0]},
+		{Text: " h\u00e9ll\u00f8 \U0001F44B "},
+		{Text: "Kappa", Emote: m.Emotes[1]},
+		{Text: "!"},
+	}
+	if fragments := m.Fragments(); !reflect.DeepEqual(fragments, expected) {
+		t.Errorf("Unexpected fragments %+v", fragments)
+	}
+
+	// Out of range and overlapping emotes don't break anything
+	m = ParseMessage("@emotes=25:0-4,2-6/1:40-45 :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :Kappa \u00e9")
+	expected = []Fragment{
+		{Text: "Kappa", Emote: &Emote{ID: "25", From: 0, To: 4, Start: 0, End: 5, Source: "twitch"}},
+		{Text: " \u00e9"},
+	}
+	if fragments := m.Fragments(); !reflect.DeepEqual(fragments, expected) {
+		t.Errorf("Unexpected fragments %+v", fragments)
+	}
+}
+
 func TestParseEmotes(t *testing.T) {
 	emotes := ParseEmotes("25:0-4,6-10,12-16,18-22,24-28,30-34,36-40,42-46,48-52,54-58,60-64,66-70,72-76,78-82,84-88,90-94,96-100,102-106,108-112,114-118,120-124,126-130")
 	comp := []*Emote{
@@ -200,18 +353,173 @@ func TestParseEmotes(t *testing.T) {
 	}
 }
 
+func TestParsePrefix(t *testing.T) {
+	prefixes := map[string]Prefix{
+		"sunspots!sunspots@sunspots.tmi.twitch.tv": {Nick: "sunspots", User: "sunspots", Host: "sunspots.tmi.twitch.tv"},
+		"tmi.twitch.tv":                   {Host: "tmi.twitch.tv"},
+		"sunsbot.tmi.twitch.tv":           {Host: "sunsbot.tmi.twitch.tv"},
+		"justinfan123":                    {Nick: "justinfan123"},
+		"sunspots@sunspots.tmi.twitch.tv": {Nick: "sunspots", Host: "sunspots.tmi.twitch.tv"},
+		"sunspots!sunspots":               {Nick: "sunspots", User: "sunspots"},
+	}
+	for raw, expected := range prefixes {
+		p := ParsePrefix(raw)
+		if p != expected {
+			t.Errorf("ParsePrefix(%q) = %+v", raw, p)
+		}
+		if p.String() != raw {
+			t.Errorf("Prefix %q didn't round trip, got %q", raw, p.String())
+		}
+	}
+	if p := ParsePrefix("tmi.twitch.tv"); !p.IsServer() || p.IsAnonymous() {
+		t.Error("Expected tmi.twitch.tv to be the server")
+	}
+	if p := ParsePrefix("justinfan123!justinfan123@justinfan123.tmi.twitch.tv"); p.IsServer() || !p.IsAnonymous() {
+		t.Error("Expected justinfan123 to be anonymous")
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags := ParseTags("display-name=Sun\\sSpots;flag;emotes=;system-msg=a\\:b;;msg-id=")
+	comp := map[string]string{
+		"display-name": "Sun Spots",
+		"flag":         "",
+		"emotes":       "",
+		"system-msg":   "a;b",
+		"msg-id":       "",
+	}
+	if !reflect.DeepEqual(tags, comp) {
+		t.Errorf("Failed parsing tags, got %q", tags)
+	}
+}
+
+var testTagValues = map[string]string{
+	"":                    "",
+	"plain":               "plain",
+	"semi\\:colon":        "semi;colon",
+	"a\\sspace":           "a space",
+	"back\\\\slash":       "back\\slash",
+	"cr\\r":               "cr\r",
+	"lf\\n":               "lf\n",
+	"\\s\\s\\:\\\\\\r\\n": "  ;\\\r\n",
+	"unknown\\b":          "unknownb",
+	"trailing\\":          "trailing",
+	"\\":                  "",
+	"double\\\\\\":        "double\\",
+}
+
+func TestUnescapeTag(t *testing.T) {
+	for escaped, value := range testTagValues {
+		if v := UnescapeTag(escaped); v != value {
+			t.Errorf("UnescapeTag(%q) = %q, expected %q", escaped, v, value)
+		}
+	}
+}
+
+func TestEscapeTag(t *testing.T) {
+	for _, value := range testTagValues {
+		if v := UnescapeTag(EscapeTag(value)); v != value {
+			t.Errorf("Escaping %q didn't round trip, got %q", value, v)
+		}
+	}
+	if v := EscapeTag("a; b\\c\r\n"); v != "a\\:\\sb\\\\c\\r\\n" {
+		t.Errorf("Unexpected escaped value %q", v)
+	}
+}
+
+func TestParseMessageInto(t *testing.T) {
+	m := AcquireMessage()
+	defer ReleaseMessage(m)
+	for raw, p := range testMessages {
+		if !ParseMessageInto(m, raw) {
+			if p != nil {
+				t.Errorf("Failed parsing message: \"%s\"", raw)
+			}
+			continue
+		}
+		if p == nil {
+			t.Errorf("Expected \"%s\" not to parse", raw)
+			continue
+		}
+		for k, v := range p.Tags {
+			if tag, ok := m.LookupTag(k); !ok || tag != v {
+				t.Errorf("Unexpected tag %s=%q in \"%s\"", k, tag, raw)
+			}
+		}
+		if _, ok := m.LookupTag("no-such-tag"); ok {
+			t.Errorf("Unexpected tag no-such-tag in \"%s\"", raw)
+		}
+		m.LoadTags()
+		m.ParseEmotes()
+		if len(m.Params) == 0 {
+			m.Params = nil
+		}
+		if len(m.Tags) == 0 {
+			m.Tags = nil
+		}
+		if !reflect.DeepEqual(m, p) {
+			t.Errorf("Failed parsing message: \"%s\"", raw)
+		}
+	}
+}
+
+const benchmarkMessage = "@badge-info=subscriber/14;badges=moderator/1,subscriber/12;color=#FF6BFF;display-name=Sunspots;emotes=;id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;mod=1;room-id=1337;subscriber=1;tmi-sent-ts=1507246572675;turbo=0;user-id=1337;user-type=mod :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :test message, lol"
+
 func BenchmarkMessage(b *testing.B) {
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		ParseMessage("@color=#FF6BFF;emotes=;subscriber=0;turbo=0;user-type= :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :test message, lol")
 	}
 }
 
+// A message with the tags Twitch sends today
+func BenchmarkMessageFullTags(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseMessage(benchmarkMessage)
+	}
+}
+
+// Parsing into the same message, reading a single tag
+func BenchmarkMessageInto(b *testing.B) {
+	b.ReportAllocs()
+	m := new(Message)
+	for i := 0; i < b.N; i++ {
+		ParseMessageInto(m, benchmarkMessage)
+		m.Tag("display-name")
+	}
+}
+
+// Parsing into pooled messages from several goroutines
+func BenchmarkMessagePooled(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m := AcquireMessage()
+			ParseMessageInto(m, benchmarkMessage)
+			m.Tag("display-name")
+			ReleaseMessage(m)
+		}
+	})
+}
+
 func BenchmarkTags(b *testing.B) {
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		ParseTags("color=#FF6BFF;emotes=;subscriber=0;turbo=0;user-type=")
 	}
 }
 
+// Loading all tags into a reused map
+func BenchmarkTagsInto(b *testing.B) {
+	b.ReportAllocs()
+	m := new(Message)
+	for i := 0; i < b.N; i++ {
+		ParseMessageInto(m, benchmarkMessage)
+		m.LoadTags()
+	}
+}
+
 func BenchmarkEmotes(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		ParseEmotes("25:0-4/1902:12-16/30259:23-29,31-37")
@@ -0,0 +1,154 @@
+package tmi
+
+// Middleware processes an incoming message before it's returned by ReadMessage.
+// It gets the message and the error from the previous middleware, and returns the message
+// to pass on, which may be modified or replaced, or nil to drop it.
+// Middlewares usually pass errors on untouched, ex.
+//
+//	func(m *tmi.Message, err error) (*tmi.Message, error) {
+//		if err != nil {
+//			return m, err
+//		}
+//		...
+//	}
+type Middleware func(*Message, error) (*Message, error)
+
+// MultiMiddleware is a Middleware that can fan out a message into several,
+// each passing through the rest of the chain. Returning none drops the message.
+type MultiMiddleware func(*Message, error) ([]*Message, error)
+
+// A message, or error, coming out of the middleware chain
+type readResult struct {
+	message *Message
+	err     error
+}
+
+// Use appends middlewares to the chain that incoming messages pass through, in order
+func (tmi *Connection) Use(mw ...Middleware) {
+	tmi.UseMulti(multi(mw)...)
+}
+
+// UseMulti appends middlewares that can fan out messages to the chain, see Use
+func (tmi *Connection) UseMulti(mw ...MultiMiddleware) {
+	tmi.Lock()
+	defer tmi.Unlock()
+	tmi.middleware = append(tmi.middleware, mw...)
+}
+
+// UseOutgoing appends middlewares to the chain that outgoing messages pass through, in order,
+// before they're queued by Send. Like incoming middlewares, they can modify or drop messages,
+// and an error stops the message from being sent and is returned by SendContext.
+func (tmi *Connection) UseOutgoing(mw ...Middleware) {
+	tmi.UseOutgoingMulti(multi(mw)...)
+}
+
+// UseOutgoingMulti appends outgoing middlewares that can fan out messages,
+// ex. to split long messages, see UseOutgoing
+func (tmi *Connection) UseOutgoingMulti(mw ...MultiMiddleware) {
+	tmi.Lock()
+	defer tmi.Unlock()
+	tmi.outgoing = append(tmi.outgoing, mw...)
+}
+
+// Turn Middlewares into MultiMiddlewares
+func multi(mw []Middleware) []MultiMiddleware {
+	multi := make([]MultiMiddleware, len(mw))
+	for i, m := range mw {
+		m := m
+		multi[i] = func(msg *Message, err error) ([]*Message, error) {
+			msg, err = m(msg, err)
+			if msg == nil {
+				return nil, err
+			}
+			return []*Message{msg}, err
+		}
+	}
+	return multi
+}
+
+// Run a message through a middleware chain, collecting what comes out the other end
+func runChain(chain []MultiMiddleware, m *Message) []readResult {
+	var results []readResult
+	var apply func(i int, m *Message, err error)
+	apply = func(i int, m *Message, err error) {
+		if i == len(chain) {
+			results = append(results, readResult{m, err})
+			return
+		}
+		out, err := chain[i](m, err)
+		if len(out) == 0 && err != nil {
+			// Errors make it through the chain, even without a message
+			apply(i+1, nil, err)
+		}
+		for _, o := range out {
+			apply(i+1, o, err)
+		}
+	}
+	apply(0, m, nil)
+	return results
+}
+
+// Run a message through the middleware chain, returning the first result and keeping the
+// rest for the following reads. Returns false if the message was dropped.
+func (tmi *Connection) runMiddleware(m *Message) (readResult, bool) {
+	tmi.Lock()
+	chain := tmi.middleware
+	tmi.Unlock()
+	if len(chain) == 0 {
+		return readResult{m, nil}, true
+	}
+
+	results := runChain(chain, m)
+	if len(results) == 0 {
+		return readResult{}, false
+	}
+
+	tmi.Lock()
+	tmi.unread = append(tmi.unread, results[1:]...)
+	tmi.Unlock()
+	return results[0], true
+}
+
+// Take the next message fanned out by the middleware, if any
+func (tmi *Connection) nextUnread() (readResult, bool) {
+	tmi.Lock()
+	defer tmi.Unlock()
+	if len(tmi.unread) == 0 {
+		return readResult{}, false
+	}
+	r := tmi.unread[0]
+	tmi.unread = tmi.unread[1:]
+	return r, true
+}
+
+// Run an outgoing line through the outgoing middleware chain, returning the lines to send
+func (tmi *Connection) runOutgoing(line string) ([]string, error) {
+	tmi.Lock()
+	chain := tmi.outgoing
+	tmi.Unlock()
+	if len(chain) == 0 {
+		return []string{line}, nil
+	}
+	m := ParseMessage(line)
+	if m == nil {
+		// Nothing to pass through the chain
+		return []string{line}, nil
+	}
+	// Messages the chain didn't change are sent as they were, since parsing trims the line
+	unchanged := string(m.BytesWithTags())
+	var lines []string
+	for _, r := range runChain(chain, m) {
+		if r.err != nil {
+			return nil, r.err
+		}
+		if r.message == nil {
+			continue
+		}
+		if out := string(r.message.BytesWithTags()); out != unchanged {
+			lines = append(lines, out)
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
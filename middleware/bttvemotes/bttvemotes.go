@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/sunspots/tmi"
 )
@@ -127,10 +128,14 @@ func (bttv *BTTVEmotes) MatchEmotes(m *tmi.Message) []*tmi.Emote {
 						pos[1]--
 					}
 				}
+				// From and To are rune positions like Twitch's, Start and End byte offsets
+				from := utf8.RuneCountInString(m.Trailing[:pos[0]])
 				foundEmotes = append(foundEmotes, &tmi.Emote{
 					ID:     emote.ID,
-					From:   pos[0],
-					To:     pos[1],
+					From:   from,
+					To:     from + utf8.RuneCountInString(m.Trailing[pos[0]:pos[1]]) - 1,
+					Start:  pos[0],
+					End:    pos[1],
 					Source: "bttv",
 				})
 			}
@@ -141,7 +146,7 @@ func (bttv *BTTVEmotes) MatchEmotes(m *tmi.Message) []*tmi.Emote {
 
 // MiddleWare works as a middleware; matching, appending and sorting BTTV emotes into m.Emotes
 func (bttv *BTTVEmotes) MiddleWare(m *tmi.Message, err error) (*tmi.Message, error) {
-	if err != nil {
+	if err != nil || m.Command != "PRIVMSG" || len(m.Params) == 0 {
 		return m, err
 	}
 	bttvEmotes := bttv.MatchEmotes(m)
@@ -38,7 +38,7 @@ func (ch *Channel) chanHandler(m *tmi.Message) {
 
 // MiddleWare is a pluggable intermediate on message handling for the TMI construct.
 func (chs *Group) MiddleWare(m *tmi.Message, err error) (*tmi.Message, error) {
-	if err != nil {
+	if err != nil || len(m.Params) == 0 {
 		return m, err
 	}
 
@@ -78,7 +78,7 @@ func (chs *Group) Part(c string) {
 		c = "#" + c
 	}
 	if _, ok := chs.Channels[c]; ok {
-		chs.Conn.Send("PART " + c)
+		chs.Conn.Part(c)
 		delete(chs.Channels, c)
 	}
 }
@@ -0,0 +1,305 @@
+// Package commands is a plugin for handling chat commands like !so @sunspots,
+// with aliases, arguments, permissions and cooldowns
+package commands
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sunspots/tmi"
+)
+
+// ErrMissingArgument is returned when reading an argument that wasn't given
+var ErrMissingArgument = errors.New("missing argument")
+
+// Permission is the level a user needs to run a command, each level includes the ones above it
+type Permission int
+
+const (
+	// Everyone can run the command
+	Everyone Permission = iota
+	// Subscriber and above can run the command
+	Subscriber
+	// VIP and above can run the command
+	VIP
+	// Moderator and the broadcaster can run the command
+	Moderator
+	// Broadcaster only can run the command
+	Broadcaster
+)
+
+// Command is a chat command
+type Command struct {
+	Name            string        // Name used after the prefix, ex. "so" for !so
+	Aliases         []string      // Other names for the command
+	Permission      Permission    // Level needed to run the command
+	Cooldown        time.Duration // Time before a user can run the command again in a channel
+	ChannelCooldown time.Duration // Time before anyone can run the command again in a channel
+	Handler         func(*Context)
+}
+
+// Context is a single run of a command
+type Context struct {
+	Message *tmi.Message
+	Channel string // Channel the command was sent in
+	User    string // Login of the user who sent the command
+	Name    string // Name or alias the command was called by
+	Args    Args
+	group   *Group
+}
+
+// Say sends a message to the command's channel, see tmi.Connection.Say
+func (c *Context) Say(text string) error {
+	return c.group.Conn.Say(c.Channel, text)
+}
+
+// Reply answers the command in a thread, see tmi.Connection.Reply
+func (c *Context) Reply(text string) error {
+	return c.group.Conn.Reply(c.Message, text)
+}
+
+// Args are a command's arguments, separated by spaces.
+// "Quoted arguments" can contain spaces, and \" inside them is a quote.
+type Args []string
+
+// String returns argument i, or "" if it wasn't given
+func (a Args) String(i int) string {
+	if i < 0 || i >= len(a) {
+		return ""
+	}
+	return a[i]
+}
+
+// Int returns argument i as an int
+func (a Args) Int(i int) (int, error) {
+	if i < 0 || i >= len(a) {
+		return 0, ErrMissingArgument
+	}
+	return strconv.Atoi(a[i])
+}
+
+// Mention returns argument i as a user login, with or without a leading @, ex. @Sunspots gives sunspots.
+// Returns false if the argument is missing or isn't a valid login.
+func (a Args) Mention(i int) (string, bool) {
+	if i < 0 || i >= len(a) {
+		return "", false
+	}
+	login := strings.ToLower(strings.TrimPrefix(a[i], "@"))
+	if login == "" {
+		return "", false
+	}
+	for _, c := range login {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return "", false
+		}
+	}
+	return login, true
+}
+
+const (
+	// Default limit on the commands running at once, see Group.MaxRunning
+	defaultMaxRunning = 10
+	// How often expired cooldowns are cleaned up
+	pruneInterval = time.Minute
+)
+
+// Group holds the commands for a connection.
+// Handlers run in their own goroutine, so a handler waiting to send doesn't hold up reading,
+// use Wait to wait for the running handlers.
+type Group struct {
+	sync.Mutex
+	Conn   *tmi.Connection
+	Prefix string // Prefix that starts a command, "!" by default
+	Drop   bool   // Drop handled commands instead of passing them on to ReadMessage
+	// MaxRunning limits the commands running at once, 0 uses the default of 10.
+	// Commands sent while at the limit are ignored, so spamming them can't pile up handlers.
+	MaxRunning int
+	running    int
+	handlers   sync.WaitGroup
+	commands   map[string]*Command
+	cooldowns  map[string]time.Time // End of cooldowns, by channel, command and user
+	pruned     time.Time            // Last time expired cooldowns were removed
+}
+
+// New creates a new command group, replying through the connection
+func New(conn *tmi.Connection) *Group {
+	return &Group{
+		Conn:      conn,
+		Prefix:    "!",
+		commands:  make(map[string]*Command),
+		cooldowns: make(map[string]time.Time),
+	}
+}
+
+// Add registers commands, by their names and aliases
+func (g *Group) Add(commands ...*Command) {
+	g.Lock()
+	defer g.Unlock()
+	for _, c := range commands {
+		g.commands[strings.ToLower(c.Name)] = c
+		for _, alias := range c.Aliases {
+			g.commands[strings.ToLower(alias)] = c
+		}
+	}
+}
+
+// MiddleWare is a pluggable intermediate on message handling for the TMI construct,
+// running the commands in chat messages
+func (g *Group) MiddleWare(m *tmi.Message, err error) (*tmi.Message, error) {
+	if err != nil || m.Command != "PRIVMSG" || m.Action || !strings.HasPrefix(m.Trailing, g.Prefix) {
+		return m, err
+	}
+	args := ParseArgs(m.Trailing[len(g.Prefix):])
+	if len(args) == 0 {
+		return m, nil
+	}
+	name := strings.ToLower(args[0])
+
+	g.Lock()
+	cmd, ok := g.commands[name]
+	g.Unlock()
+	if !ok || cmd.Handler == nil {
+		return m, nil
+	}
+	ctx := &Context{
+		Message: m,
+		Channel: m.Channel(),
+		User:    m.Tag("login"),
+		Name:    name,
+		Args:    args[1:],
+		group:   g,
+	}
+	if ctx.User == "" {
+		ctx.User = m.Prefix.Nick
+	}
+	level := permission(m)
+	if level < cmd.Permission || !g.start() {
+		return m, nil
+	}
+	if !g.cooldown(cmd, ctx, level) {
+		g.finish()
+		return m, nil
+	}
+	go func() {
+		defer g.finish()
+		cmd.Handler(ctx)
+	}()
+	if g.Drop {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// Reserve a spot for running a command, returns false if at the MaxRunning limit
+func (g *Group) start() bool {
+	g.Lock()
+	defer g.Unlock()
+	max := g.MaxRunning
+	if max <= 0 {
+		max = defaultMaxRunning
+	}
+	if g.running >= max {
+		return false
+	}
+	g.running++
+	g.handlers.Add(1)
+	return true
+}
+
+// Release the spot taken by start
+func (g *Group) finish() {
+	g.Lock()
+	g.running--
+	g.Unlock()
+	g.handlers.Done()
+}
+
+// Wait waits for the running command handlers to finish
+func (g *Group) Wait() {
+	g.handlers.Wait()
+}
+
+// Check and start the command's cooldowns, returns false if it's cooling down.
+// Moderators and the broadcaster aren't affected by cooldowns.
+func (g *Group) cooldown(cmd *Command, ctx *Context, level Permission) bool {
+	if level >= Moderator {
+		return true
+	}
+	now := time.Now()
+	channelKey := ctx.Channel + " " + cmd.Name
+	userKey := channelKey + " " + ctx.User
+
+	g.Lock()
+	defer g.Unlock()
+	if now.Sub(g.pruned) >= pruneInterval {
+		// Every user who ran a command has an entry, don't keep them around forever
+		for key, end := range g.cooldowns {
+			if !now.Before(end) {
+				delete(g.cooldowns, key)
+			}
+		}
+		g.pruned = now
+	}
+	if now.Before(g.cooldowns[channelKey]) || now.Before(g.cooldowns[userKey]) {
+		return false
+	}
+	delete(g.cooldowns, channelKey)
+	delete(g.cooldowns, userKey)
+	if cmd.ChannelCooldown > 0 {
+		g.cooldowns[channelKey] = now.Add(cmd.ChannelCooldown)
+	}
+	if cmd.Cooldown > 0 {
+		g.cooldowns[userKey] = now.Add(cmd.Cooldown)
+	}
+	return true
+}
+
+// The highest permission level of the message's user
+func permission(m *tmi.Message) Permission {
+	switch {
+	case m.IsBroadcaster():
+		return Broadcaster
+	case m.IsModerator():
+		return Moderator
+	case m.IsVIP():
+		return VIP
+	case m.IsSubscriber():
+		return Subscriber
+	}
+	return Everyone
+}
+
+// ParseArgs splits a command line into arguments, see Args
+func ParseArgs(s string) Args {
+	var args Args
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s) && s[i+1] == '"':
+			arg.WriteByte('"')
+			i++
+		case c == '"' && (quoted || !inArg):
+			// Quotes only open at the start of an argument
+			quoted = !quoted
+			inArg = true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
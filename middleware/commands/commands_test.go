@@ -0,0 +1,167 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sunspots/tmi"
+)
+
+func TestParseArgs(t *testing.T) {
+	args := map[string]Args{
+		"so @Sunspots":                    {"so", "@Sunspots"},
+		"  spaced   out ":                 {"spaced", "out"},
+		`title "Playing some \"Go\"" now`: {"title", `Playing some "Go"`, "now"},
+		`empty "" quote`:                  {"empty", "", "quote"},
+		`unterminated "quote here`:        {"unterminated", "quote here"},
+		`mid"quote`:                       {`mid"quote`},
+		"":                                nil,
+	}
+	for s, expected := range args {
+		if a := ParseArgs(s); !reflect.DeepEqual(a, expected) {
+			t.Errorf("ParseArgs(%q) = %q, expected %q", s, a, expected)
+		}
+	}
+
+	a := ParseArgs("10 x @Sunspots not-a-login")
+	if i, err := a.Int(0); err != nil || i != 10 {
+		t.Errorf("Unexpected int %d, %v", i, err)
+	}
+	if _, err := a.Int(1); err == nil {
+		t.Error("Expected an error for a non number")
+	}
+	if _, err := a.Int(9); err != ErrMissingArgument {
+		t.Errorf("Expected ErrMissingArgument, got %v", err)
+	}
+	if login, ok := a.Mention(2); !ok || login != "sunspots" {
+		t.Errorf("Unexpected mention %q", login)
+	}
+	if login, ok := a.Mention(1); !ok || login != "x" {
+		t.Errorf("Unexpected mention %q", login)
+	}
+	if _, ok := a.Mention(3); ok {
+		t.Error("Expected an invalid mention")
+	}
+	if a.String(9) != "" {
+		t.Error("Expected an empty missing argument")
+	}
+}
+
+func TestCommands(t *testing.T) {
+	conn := tmi.New("sunsbot", "")
+	var sent []string
+	conn.UseOutgoing(func(m *tmi.Message, err error) (*tmi.Message, error) {
+		sent = append(sent, string(m.BytesWithTags()))
+		return nil, nil
+	})
+
+	g := New(conn)
+	var ran []string
+	g.Add(&Command{
+		Name:     "shoutout",
+		Aliases:  []string{"so"},
+		Cooldown: time.Hour,
+		Handler: func(c *Context) {
+			login, _ := c.Args.Mention(0)
+			ran = append(ran, c.User+" "+c.Name+" "+login)
+			c.Reply("Go follow " + login)
+		},
+	}, &Command{
+		Name:       "ban",
+		Permission: Moderator,
+		Handler: func(c *Context) {
+			ran = append(ran, c.User+" ban")
+			c.Say("Bye " + c.Args.String(0))
+		},
+	})
+
+	for _, raw := range []string{
+		"@id=1;login=viewer :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :!SO @Sunspots",
+		// Cooling down for viewer
+		"@id=2;login=viewer :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :!shoutout @Sunspots",
+		"@id=3;login=other :other!other@other.tmi.twitch.tv PRIVMSG #sunspots :!shoutout @Sunsbot",
+		// Not a moderator
+		"@id=4;login=viewer :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :!ban other",
+		"@badges=moderator/1;id=5;login=mod;mod=1 :mod!mod@mod.tmi.twitch.tv PRIVMSG #sunspots :!ban other",
+		// Not commands
+		"@id=6;login=viewer :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :hi !so",
+		"@id=7;login=viewer :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :!unknown",
+	} {
+		m := tmi.ParseMessage(raw)
+		if out, err := g.MiddleWare(m, nil); out != m || err != nil {
+			t.Errorf("Expected %q to be passed on", raw)
+		}
+		// Handlers run on their own goroutine
+		g.Wait()
+	}
+
+	expectedRan := []string{"viewer so sunspots", "other shoutout sunsbot", "mod ban"}
+	if !reflect.DeepEqual(ran, expectedRan) {
+		t.Errorf("Expected %q to run, got %q", expectedRan, ran)
+	}
+	expectedSent := []string{
+		"@reply-parent-msg-id=1 PRIVMSG #sunspots :Go follow sunspots",
+		"@reply-parent-msg-id=3 PRIVMSG #sunspots :Go follow sunsbot",
+		"PRIVMSG #sunspots :Bye other",
+	}
+	if !reflect.DeepEqual(sent, expectedSent) {
+		t.Errorf("Expected %q to be sent, got %q", expectedSent, sent)
+	}
+
+	g.Drop = true
+	m := tmi.ParseMessage(":mod!mod@mod.tmi.twitch.tv PRIVMSG #sunspots :!ban other")
+	if out, _ := g.MiddleWare(m, nil); out != m {
+		t.Error("Expected a command the user can't run to be passed on")
+	}
+	m = tmi.ParseMessage("@badges=broadcaster/1 :sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :!ban other")
+	if out, _ := g.MiddleWare(m, nil); out != nil {
+		t.Error("Expected the handled command to be dropped")
+	}
+}
+
+func TestMaxRunning(t *testing.T) {
+	g := New(tmi.New("sunsbot", ""))
+	g.MaxRunning = 1
+	release := make(chan bool)
+	ran := make(chan string, 2)
+	g.Add(&Command{
+		Name: "slow",
+		Handler: func(c *Context) {
+			ran <- c.Message.Tag("id")
+			<-release
+		},
+	})
+
+	// The handler doesn't block reading, and commands over the limit are ignored
+	g.MiddleWare(tmi.ParseMessage("@id=1 :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :!slow"), nil)
+	g.MiddleWare(tmi.ParseMessage("@id=2 :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :!slow"), nil)
+	close(release)
+	g.Wait()
+	g.MiddleWare(tmi.ParseMessage("@id=3 :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :!slow"), nil)
+	g.Wait()
+	close(ran)
+	var ids []string
+	for id := range ran {
+		ids = append(ids, id)
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "3"}) {
+		t.Errorf("Expected commands 1 and 3 to run, got %q", ids)
+	}
+}
+
+func TestCooldownPrune(t *testing.T) {
+	g := New(tmi.New("sunsbot", ""))
+	g.Add(&Command{Name: "hi", Cooldown: time.Hour, Handler: func(c *Context) {}})
+	g.cooldowns["#sunspots hi gone"] = time.Now().Add(-time.Second)
+	g.MiddleWare(tmi.ParseMessage(":viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #sunspots :!hi"), nil)
+	g.Wait()
+	expected := []string{"#sunspots hi viewer"}
+	var keys []string
+	for key := range g.cooldowns {
+		keys = append(keys, key)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the expired cooldown to be removed, got %q", keys)
+	}
+}
@@ -0,0 +1,154 @@
+package tmi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMiddleware(t *testing.T) {
+	conn := New("sunsbot", "")
+	conn.MessageChan = make(chan *Message, 10)
+	for _, raw := range []string{
+		":tmi.twitch.tv PING",
+		":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :hello",
+		":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :a|b|c",
+		":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :fail",
+	} {
+		conn.MessageChan <- ParseMessage(raw)
+	}
+	close(conn.MessageChan)
+
+	errFail := errors.New("fail")
+	conn.Use(
+		// Drop
+		func(m *Message, err error) (*Message, error) {
+			if m.Command == "PING" {
+				return nil, nil
+			}
+			return m, err
+		},
+		// Fail
+		func(m *Message, err error) (*Message, error) {
+			if m.Trailing == "fail" {
+				return nil, errFail
+			}
+			return m, err
+		},
+	)
+	// Fan out
+	conn.UseMulti(func(m *Message, err error) ([]*Message, error) {
+		if err != nil {
+			return nil, err
+		}
+		var out []*Message
+		for _, part := range strings.Split(m.Trailing, "|") {
+			split := *m
+			split.Trailing = part
+			out = append(out, &split)
+		}
+		return out, nil
+	})
+	// Mutate
+	conn.Use(func(m *Message, err error) (*Message, error) {
+		if err != nil {
+			return m, err
+		}
+		m.Trailing = strings.ToUpper(m.Trailing)
+		return m, nil
+	})
+
+	for _, expected := range []string{"HELLO", "A", "B", "C"} {
+		m, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Trailing != expected {
+			t.Errorf("Expected %q, got %q", expected, m.Trailing)
+		}
+	}
+	if m, err := conn.ReadMessage(); m != nil || err != errFail {
+		t.Errorf("Expected the middleware's error, got %v, %v", m, err)
+	}
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Error("Expected an error after the channel was closed")
+	}
+}
+
+func TestOutgoingMiddlewarePassThrough(t *testing.T) {
+	conn, server := pipeConnection(t)
+	defer conn.Disconnect()
+	conn.UseOutgoing(func(m *Message, err error) (*Message, error) {
+		return m, err
+	})
+
+	// Unchanged lines are sent as they are, not trimmed or truncated
+	text := strings.Repeat("é", 400)
+	if err := conn.Say("sunspots", text); err != nil {
+		t.Fatal(err)
+	}
+	if line := server.expect(t, "PRIVMSG"); line != "PRIVMSG #sunspots :"+text {
+		t.Errorf("Unexpected line of %d bytes, valid UTF-8: %v", len(line), utf8.ValidString(line))
+	}
+	if err := conn.SendContext(context.Background(), "PRIVMSG #sunspots :spaced  "); err != nil {
+		t.Fatal(err)
+	}
+	if line := server.expect(t, "PRIVMSG"); line != "PRIVMSG #sunspots :spaced  " {
+		t.Errorf("Unexpected line %q", line)
+	}
+}
+
+func TestOutgoingMiddleware(t *testing.T) {
+	conn, server := pipeConnection(t)
+	defer conn.Disconnect()
+
+	errBlocked := errors.New("blocked")
+	conn.UseOutgoing(
+		// Redact
+		func(m *Message, err error) (*Message, error) {
+			m.Trailing = strings.ReplaceAll(m.Trailing, "secret", "******")
+			return m, err
+		},
+		// Drop and block
+		func(m *Message, err error) (*Message, error) {
+			switch m.Trailing {
+			case "drop":
+				return nil, nil
+			case "block":
+				return nil, errBlocked
+			}
+			return m, err
+		},
+	)
+	// Split
+	conn.UseOutgoingMulti(func(m *Message, err error) ([]*Message, error) {
+		if err != nil {
+			return nil, err
+		}
+		if m.Command != "PRIVMSG" {
+			return []*Message{m}, nil
+		}
+		var out []*Message
+		for _, part := range strings.Split(m.Trailing, "|") {
+			split := *m
+			split.Trailing = part
+			out = append(out, &split)
+		}
+		return out, nil
+	})
+
+	if err := conn.SendContext(context.Background(), "PRIVMSG #sunspots :drop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SendContext(context.Background(), "PRIVMSG #sunspots :block"); err != errBlocked {
+		t.Errorf("Expected the middleware's error, got %v", err)
+	}
+	conn.Send("PRIVMSG #sunspots :my secret|is safe")
+	for _, expected := range []string{"PRIVMSG #sunspots :my ******", "PRIVMSG #sunspots :is safe"} {
+		if line := server.expect(t, "PRIVMSG"); line != expected {
+			t.Errorf("Expected %q, got %q", expected, line)
+		}
+	}
+}
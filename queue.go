@@ -0,0 +1,48 @@
+package tmi
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// Default capacity of each outgoing lane
+	sendQueueSize = 10
+)
+
+// ErrSendQueueFull is returned when sending with the SendDrop policy and the queue is full
+var ErrSendQueueFull = errors.New("send queue is full")
+
+// SendPolicy decides what happens when sending to a full send queue
+type SendPolicy int
+
+const (
+	// SendBlock waits until there is room in the queue
+	SendBlock SendPolicy = iota
+	// SendDrop drops the message, SendContext returns ErrSendQueueFull
+	SendDrop
+)
+
+// Commands sent on the control lane, bypassing queued and rate limited chat messages
+var controlCommands = map[string]bool{
+	"PASS": true,
+	"NICK": true,
+	"CAP":  true,
+	"PING": true,
+	"PONG": true,
+	"JOIN": true,
+	"PART": true,
+	"QUIT": true,
+}
+
+// Pick the outgoing lane for a line
+func (tmi *Connection) lane(line string) chan string {
+	command := line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		command = line[:i]
+	}
+	if controlCommands[strings.ToUpper(command)] {
+		return tmi.control
+	}
+	return tmi.chat
+}
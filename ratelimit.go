@@ -0,0 +1,168 @@
+package tmi
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a number of messages allowed within a period
+type RateLimit struct {
+	Messages int
+	Per      time.Duration
+}
+
+// Limits configures the rate limits for outgoing chat messages and joins.
+// Twitch counts messages across all channels, with a higher limit
+// in channels where we are moderator, VIP or broadcaster.
+type Limits struct {
+	User      RateLimit // Shared by all channels where we're a regular user
+	Moderator RateLimit // Applies to each channel where we're moderator, VIP or broadcaster
+	Join      RateLimit // JOIN attempts, each channel in a JOIN counts as one
+}
+
+var (
+	// RateLimitUser is Twitch's limit for regular users
+	RateLimitUser = RateLimit{Messages: 20, Per: 30 * time.Second}
+	// RateLimitModerator is Twitch's limit for moderators, VIPs and broadcasters
+	RateLimitModerator = RateLimit{Messages: 100, Per: 30 * time.Second}
+	// RateLimitVerified is Twitch's limit for verified bots
+	RateLimitVerified = RateLimit{Messages: 7500, Per: 30 * time.Second}
+	// RateLimitJoin is Twitch's JOIN limit for regular accounts
+	RateLimitJoin = RateLimit{Messages: 20, Per: 10 * time.Second}
+	// RateLimitJoinVerified is Twitch's JOIN limit for verified bots
+	RateLimitJoinVerified = RateLimit{Messages: 2000, Per: 10 * time.Second}
+
+	// DefaultLimits are the limits for a regular account
+	DefaultLimits = Limits{User: RateLimitUser, Moderator: RateLimitModerator, Join: RateLimitJoin}
+	// VerifiedLimits are the limits for a verified bot
+	VerifiedLimits = Limits{User: RateLimitVerified, Moderator: RateLimitVerified, Join: RateLimitJoinVerified}
+)
+
+// bucket is a token bucket, refilling continuously up to the limit
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit RateLimit, now time.Time) *bucket {
+	return &bucket{limit: limit, tokens: float64(limit.Messages), last: now}
+}
+
+// Take a token, or return how long to wait until one is available
+func (b *bucket) take(now time.Time) time.Duration {
+	_, wait := b.takeUpTo(1, now)
+	return wait
+}
+
+// Take as many tokens as are available, up to max.
+// If none are available, return how long to wait until one is.
+func (b *bucket) takeUpTo(max int, now time.Time) (int, time.Duration) {
+	if b.limit.Messages <= 0 || b.limit.Per <= 0 {
+		return max, 0
+	}
+	rate := float64(b.limit.Messages) / float64(b.limit.Per)
+	b.tokens += float64(now.Sub(b.last)) * rate
+	if limit := float64(b.limit.Messages); b.tokens > limit {
+		b.tokens = limit
+	}
+	b.last = now
+	n := int(b.tokens)
+	if n > max {
+		n = max
+	}
+	if n > 0 {
+		b.tokens -= float64(n)
+		return n, 0
+	}
+	return 0, time.Duration((1-b.tokens)/rate) + 1
+}
+
+// limiter applies Limits to outgoing PRIVMSGs, based on our USERSTATE in each channel
+type limiter struct {
+	sync.Mutex
+	limits   Limits
+	user     *bucket
+	join     *bucket
+	channels map[string]*bucket // Buckets for channels where we're elevated
+}
+
+func newLimiter(limits Limits) *limiter {
+	return &limiter{
+		limits:   limits,
+		user:     newBucket(limits.User, time.Now()),
+		join:     newBucket(limits.Join, time.Now()),
+		channels: make(map[string]*bucket),
+	}
+}
+
+// Reserve up to max joins, returning how long to wait before trying again if none are available
+func (l *limiter) reserveJoins(max int, now time.Time) (int, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	return l.join.takeUpTo(max, now)
+}
+
+// Reserve a message in the channel, returning how long to wait before trying again if none is available
+func (l *limiter) reserve(channel string, now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if b, ok := l.channels[channel]; ok {
+		return b.take(now)
+	}
+	return l.user.take(now)
+}
+
+// Update wether we're moderator, VIP or broadcaster in a channel
+func (l *limiter) elevate(channel string, elevated bool) {
+	l.Lock()
+	defer l.Unlock()
+	if !elevated {
+		delete(l.channels, channel)
+	} else if _, ok := l.channels[channel]; !ok {
+		l.channels[channel] = newBucket(l.limits.Moderator, time.Now())
+	}
+}
+
+// Wait for the rate limit before sending a line, writing control messages in the meantime.
+// Returns false if the session ends while waiting.
+func (tmi *Connection) limit(s *session, line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0][0] == prefixTags {
+		// Skip the tags, ex. on replies
+		fields = fields[1:]
+	}
+	if tmi.limiter == nil || len(fields) < 2 || fields[0] != "PRIVMSG" {
+		return true
+	}
+	channel := fields[1]
+	for {
+		wait := tmi.limiter.reserve(channel, time.Now())
+		if wait <= 0 {
+			return true
+		}
+		timer := time.NewTimer(wait)
+	waiting:
+		for {
+			select {
+			case <-timer.C:
+				break waiting
+			case control := <-tmi.control:
+				if err := tmi.write(s, control); err != nil {
+					timer.Stop()
+					s.fail(err)
+					return false
+				}
+			case <-s.end:
+				timer.Stop()
+				return false
+			}
+		}
+	}
+}
+
+// Tells us wether a USERSTATE gives us the elevated rate limit
+func elevated(m *Message) bool {
+	return m.IsModerator() || m.IsVIP() || m.IsBroadcaster()
+}
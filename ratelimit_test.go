@@ -0,0 +1,55 @@
+package tmi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(Limits{
+		User:      RateLimit{Messages: 2, Per: time.Second},
+		Moderator: RateLimit{Messages: 4, Per: time.Second},
+	})
+	l.user.last = now
+
+	// Regular channels share the user bucket
+	if l.reserve("#a", now) != 0 || l.reserve("#b", now) != 0 {
+		t.Fatal("expected the first two messages to pass")
+	}
+	if wait := l.reserve("#a", now); wait <= 0 || wait > 500*time.Millisecond+time.Nanosecond {
+		t.Errorf("expected to wait about 500ms, got %s", wait)
+	}
+	if l.reserve("#a", now.Add(500*time.Millisecond)) != 0 {
+		t.Error("expected a token to be available after 500ms")
+	}
+
+	// Elevated channels get their own bucket
+	l.elevate("#mod", true)
+	for i := 0; i < 4; i++ {
+		if wait := l.reserve("#mod", time.Now()); wait != 0 {
+			t.Fatalf("message %d in moderated channel had to wait %s", i, wait)
+		}
+	}
+	if l.reserve("#mod", time.Now()) == 0 {
+		t.Error("expected the moderator bucket to be empty")
+	}
+	l.elevate("#mod", false)
+	if _, ok := l.channels["#mod"]; ok {
+		t.Error("expected the channel to use the user bucket again")
+	}
+}
+
+func TestElevated(t *testing.T) {
+	for raw, expected := range map[string]bool{
+		"@badges=broadcaster/1;mod=0 :tmi.twitch.tv USERSTATE #sunspots": true,
+		"@badges=vip/1;mod=0 :tmi.twitch.tv USERSTATE #sunspots":         true,
+		"@badges=;mod=1 :tmi.twitch.tv USERSTATE #sunspots":              true,
+		"@badges=subscriber/12;mod=0 :tmi.twitch.tv USERSTATE #sunspots": false,
+		"@badges=;mod=0;user-type= :tmi.twitch.tv USERSTATE #sunspots":   false,
+	} {
+		if elevated(ParseMessage(raw)) != expected {
+			t.Errorf("%q: expected elevated to be %v", raw, expected)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package tmi
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ReconnectPolicy configures automatic reconnection for a Connection.
+// When the connection is lost, reconnection is attempted with an exponential backoff,
+// re-authenticating, requesting capabilities and rejoining channels, while MessageChan stays open.
+type ReconnectPolicy struct {
+	MaxAttempts int           // Attempts before giving up and disconnecting, 0 retries forever
+	MinDelay    time.Duration // Delay before the first attempt
+	MaxDelay    time.Duration // Upper bound for the delay between attempts
+	Jitter      float64       // Fraction of each delay to randomly add or subtract, between 0 and 1
+
+	// The callbacks are run in order on their own goroutine, so they may call Disconnect,
+	// but they can run after the connection has moved on, ex. OnReconnect after a new disconnect.
+	OnDisconnect      func(err error)              // Called when the connection is lost
+	OnReconnectFailed func(attempt int, err error) // Called when an attempt fails
+	OnReconnect       func(attempt int)            // Called once reconnected
+}
+
+// DefaultReconnectPolicy returns a policy retrying forever,
+// starting at one second between attempts and backing off to two minutes
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		MinDelay: time.Second,
+		MaxDelay: 2 * time.Minute,
+		Jitter:   0.2,
+	}
+}
+
+// Delay returns how long to wait before the given attempt, counting from 1
+func (p *ReconnectPolicy) Delay(attempt int) time.Duration {
+	delay := p.MinDelay
+	// Stop doubling well before overflowing, in case MaxDelay isn't set
+	for i := 1; i < attempt && delay > 0 && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * (rand.Float64()*2 - 1))
+	}
+	return delay
+}
+
+// callbacks runs the ReconnectPolicy's callbacks one after another, off the controlLoop,
+// which would otherwise deadlock when a callback waits for it, ex. by calling Disconnect
+type callbacks struct {
+	sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// Queue a callback, starting a goroutine to run the queue if there isn't one
+func (c *callbacks) run(f func()) {
+	c.Lock()
+	defer c.Unlock()
+	c.queue = append(c.queue, f)
+	if !c.running {
+		c.running = true
+		go c.loop()
+	}
+}
+
+func (c *callbacks) loop() {
+	for {
+		c.Lock()
+		if len(c.queue) == 0 {
+			c.running = false
+			c.Unlock()
+			return
+		}
+		f := c.queue[0]
+		c.queue = c.queue[1:]
+		c.Unlock()
+		f()
+	}
+}
+
+// Attempt to replace the failed session according to the AutoReconnect policy.
+// Returns false if the policy gave up, or the connection was stopped while waiting.
+func (tmi *Connection) reconnect(err error) bool {
+	policy := tmi.AutoReconnect
+	if policy.OnDisconnect != nil {
+		tmi.callbacks.run(func() { policy.OnDisconnect(err) })
+	}
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		timer := time.NewTimer(policy.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-tmi.end:
+			timer.Stop()
+			return false
+		}
+
+		s, err := tmi.newSession(tmi.ctx)
+		if err != nil {
+			log.Printf("Reconnect attempt %d failed: %s\n", attempt, err)
+			if policy.OnReconnectFailed != nil {
+				attempt := attempt
+				tmi.callbacks.run(func() { policy.OnReconnectFailed(attempt, err) })
+			}
+			if err == ErrAuthFailed || err == ErrImproperlyFormattedAuth {
+				// Retrying won't make the credentials any better
+				break
+			}
+			continue
+		}
+		tmi.Lock()
+		tmi.session = s
+		tmi.Unlock()
+		tmi.activate(s, nil)
+		if policy.OnReconnect != nil {
+			attempt := attempt
+			tmi.callbacks.run(func() { policy.OnReconnect(attempt) })
+		}
+		return true
+	}
+	log.Println("Giving up reconnecting")
+	return false
+}
+
+// Migrate to a new session when the server sends RECONNECT, making the new
+// connection before breaking the old one. The new session holds its messages
+// until it has rejoined all channels, then it takes over delivery,
+// skipping messages the old session already delivered.
+func (tmi *Connection) migrate() {
+	old := tmi.session
+	old.Lock()
+	old.delivered = make(map[string]bool)
+	old.Unlock()
+
+	s, err := tmi.newSession(tmi.ctx)
+	if err != nil {
+		// The old session will fail eventually, and be handled as any other error
+		log.Printf("Failed to open a new connection after RECONNECT: %s\n", err)
+		return
+	}
+
+	timer := time.NewTimer(tmi.Timeout)
+	defer timer.Stop()
+	select {
+	case <-s.ready:
+	case <-timer.C:
+		log.Println("Timed out rejoining channels after RECONNECT, switching anyway")
+	case <-old.failed:
+		// Nothing more to wait for, the new session takes over right away
+	case err = <-s.failed:
+		log.Printf("New connection failed after RECONNECT: %s\n", err)
+		s.close()
+		return
+	case <-tmi.end:
+		s.close()
+		return
+	}
+
+	old.close()
+	tmi.Lock()
+	tmi.session = s
+	tmi.Unlock()
+	tmi.activate(s, old)
+	log.Println("Switched to new connection after RECONNECT")
+}
@@ -0,0 +1,140 @@
+package tmi
+
+import (
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Handler handles an incoming message, see Router
+type Handler func(*Message)
+
+// RouterMode decides how a Router runs its handlers
+type RouterMode int
+
+const (
+	// RouteSequential handles one message at a time, in the order they're read
+	RouteSequential RouterMode = iota
+	// RouteConcurrent handles each message in its own goroutine, see Router.Workers.
+	// The handlers for a single message still run one after another.
+	RouteConcurrent
+)
+
+// Router dispatches incoming messages to the handlers registered for their command.
+// It's optional, reading with Connection.ReadMessage works just as well.
+type Router struct {
+	sync.WaitGroup
+	sync.Mutex
+	Mode    RouterMode // How handlers are run, RouteSequential by default
+	Workers int        // Limits the messages handled at once with RouteConcurrent, 0 means no limit. Set before dispatching.
+	// OnPanic is called when a handler panics, nil logs the panic.
+	// Other handlers keep running either way.
+	OnPanic  func(m *Message, recovered interface{})
+	handlers map[string][]Handler
+	workers  chan bool
+}
+
+// NewRouter creates a Router without any handlers
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string][]Handler)}
+}
+
+// On registers a handler for a command, ex. CLEARCHAT or 366.
+// The command "*" handles every message, before the command's own handlers.
+func (r *Router) On(command string, h Handler) {
+	r.Lock()
+	defer r.Unlock()
+	if r.handlers == nil {
+		r.handlers = make(map[string][]Handler)
+	}
+	command = strings.ToUpper(command)
+	r.handlers[command] = append(r.handlers[command], h)
+}
+
+// OnPrivmsg registers a handler for chat messages
+func (r *Router) OnPrivmsg(h func(*PrivateMessage)) {
+	r.On("PRIVMSG", func(m *Message) {
+		if p, ok := m.Typed().(*PrivateMessage); ok {
+			h(p)
+		}
+	})
+}
+
+// OnUserNotice registers a handler for subs, raids and other user events
+func (r *Router) OnUserNotice(h func(*UserNotice)) {
+	r.On("USERNOTICE", func(m *Message) {
+		if n, ok := m.Typed().(*UserNotice); ok {
+			h(n)
+		}
+	})
+}
+
+// Dispatch runs the handlers for a message, according to the Router's Mode
+func (r *Router) Dispatch(m *Message) {
+	r.Lock()
+	handlers := make([]Handler, 0, len(r.handlers["*"])+len(r.handlers[m.Command]))
+	handlers = append(handlers, r.handlers["*"]...)
+	handlers = append(handlers, r.handlers[m.Command]...)
+	if r.Mode == RouteConcurrent && r.Workers > 0 && r.workers == nil {
+		r.workers = make(chan bool, r.Workers)
+	}
+	workers := r.workers
+	r.Unlock()
+	if len(handlers) == 0 {
+		return
+	}
+
+	if r.Mode != RouteConcurrent {
+		r.run(m, handlers)
+		return
+	}
+	if workers != nil {
+		// Wait for a free worker
+		workers <- true
+	}
+	r.Add(1)
+	go func() {
+		defer r.Done()
+		r.run(m, handlers)
+		if workers != nil {
+			<-workers
+		}
+	}()
+}
+
+// Run reads messages from the connection and dispatches them, until reading fails.
+// It waits for running handlers to finish, then returns the read error.
+func (r *Router) Run(conn Connector) error {
+	defer r.Wait()
+	for {
+		m, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			r.Dispatch(m)
+		}
+	}
+}
+
+// Run the handlers one after another
+func (r *Router) run(m *Message, handlers []Handler) {
+	for _, h := range handlers {
+		r.call(m, h)
+	}
+}
+
+// Call a handler, recovering if it panics
+func (r *Router) call(m *Message, h Handler) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if r.OnPanic != nil {
+				r.OnPanic(m, rec)
+				return
+			}
+			log.Printf("Handler for %s panicked: %v\n%s", m.Command, rec, debug.Stack())
+		}
+	}()
+	h(m)
+}
@@ -0,0 +1,117 @@
+package tmi
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Connector that reads messages from a slice, all other methods are left unimplemented
+type sliceConnector struct {
+	Connector
+	messages []*Message
+}
+
+var errDone = errors.New("no more messages")
+
+func (c *sliceConnector) ReadMessage() (*Message, error) {
+	if len(c.messages) == 0 {
+		return nil, errDone
+	}
+	m := c.messages[0]
+	c.messages = c.messages[1:]
+	return m, nil
+}
+
+func testConnector(raw ...string) *sliceConnector {
+	c := new(sliceConnector)
+	for _, r := range raw {
+		c.messages = append(c.messages, ParseMessage(r))
+	}
+	return c
+}
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+	var got []string
+	r.On("*", func(m *Message) {
+		got = append(got, "* "+m.Command)
+	})
+	r.OnPrivmsg(func(p *PrivateMessage) {
+		got = append(got, "privmsg "+p.User.Name+" "+p.Text)
+	})
+	r.OnUserNotice(func(n *UserNotice) {
+		got = append(got, "usernotice "+n.MsgID)
+	})
+	r.On("clearchat", func(m *Message) {
+		panic("oops")
+	})
+	r.On("CLEARCHAT", func(m *Message) {
+		got = append(got, "clearchat "+m.Trailing)
+	})
+	var panicked interface{}
+	r.OnPanic = func(m *Message, recovered interface{}) {
+		panicked = recovered
+	}
+
+	conn := testConnector(
+		":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :hi",
+		"@msg-id=raid :tmi.twitch.tv USERNOTICE #sunspots",
+		":tmi.twitch.tv CLEARCHAT #sunspots :sunsbot",
+	)
+	if err := r.Run(conn); err != errDone {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+	expected := []string{
+		"* PRIVMSG", "privmsg sunspots hi",
+		"* USERNOTICE", "usernotice raid",
+		"* CLEARCHAT", "clearchat sunsbot",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected, got)
+			break
+		}
+	}
+	if panicked != "oops" {
+		t.Errorf("Expected the panic to be recovered, got %v", panicked)
+	}
+}
+
+func TestRouterConcurrent(t *testing.T) {
+	r := NewRouter()
+	r.Mode = RouteConcurrent
+	r.Workers = 2
+
+	var running, max, handled int32
+	var mu sync.Mutex
+	r.On("PRIVMSG", func(m *Message) {
+		n := atomic.AddInt32(&running, 1)
+		mu.Lock()
+		if n > max {
+			max = n
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&handled, 1)
+	})
+
+	var raw []string
+	for i := 0; i < 6; i++ {
+		raw = append(raw, ":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :hi")
+	}
+	r.Run(testConnector(raw...))
+	// Run waits for the handlers
+	if handled != 6 {
+		t.Errorf("Expected 6 handled messages, got %d", handled)
+	}
+	if max != 2 {
+		t.Errorf("Expected 2 messages handled at once, got %d", max)
+	}
+}
@@ -2,137 +2,364 @@ package tmi
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // The main loop to read messages from the server, runs as a goroutine.
-func (tmi *Connection) readLoop() {
+func (tmi *Connection) readLoop(s *session) {
 	defer func() {
 		log.Println("Reader closed")
-		tmi.Done()
+		s.Done()
 	}()
-	br := bufio.NewReaderSize(tmi.socket, maxMessageSize)
+	br := bufio.NewReaderSize(s.socket, maxMessageSize)
 
 	for {
 		select {
-		case <-tmi.end:
+		case <-s.end:
 			return
 		default:
-			if tmi.socket != nil {
-				tmi.socket.SetReadDeadline(time.Now().Add(tmi.Timeout*2 + tmi.KeepAlive))
-			}
+			s.socket.SetReadDeadline(time.Now().Add(tmi.Timeout*2 + tmi.KeepAlive))
 			msg, err := br.ReadString('\n')
 			if err != nil {
-				tmi.Error <- err
+				s.fail(err)
 				return
 			}
-			if tmi.socket != nil {
-				var zero time.Time
-				tmi.socket.SetReadDeadline(zero)
-			}
-			tmi.lastMessage = time.Now()
+			var zero time.Time
+			s.socket.SetReadDeadline(zero)
+			atomic.StoreInt64(&s.lastMessage, time.Now().UnixNano())
 
 			if tmi.Debug {
 				dbg.Print("< ", msg)
 			}
 
 			message := ParseMessage(msg)
+			if message == nil {
+				continue
+			}
 			if message.Command == "PING" {
-				tmi.Send("PONG " + message.Trailing)
+				// Answer straight away, on the socket that was pinged
+				if err = tmi.write(s, "PONG "+message.Trailing); err != nil {
+					s.fail(err)
+					return
+				}
 				continue
 			}
-			tmi.MessageChan <- message
+			tmi.handle(s, message)
+			if !tmi.deliver(s, msg, message) {
+				return
+			}
 		}
 	}
 }
 
 // The writeloop synchronously sends messages
-// that it picks up from the send channel
-func (tmi *Connection) writeLoop() {
+// that it picks up from the control and chat lanes.
+// Control messages are always sent first, also while waiting for the chat rate limit.
+func (tmi *Connection) writeLoop(s *session) {
 	defer func() {
 		log.Println("Writer closed")
-		tmi.Done()
+		s.Done()
 	}()
 	for {
+		var line string
+		chat := true
 		select {
-		case s, ok := <-tmi.send:
-			if !ok {
-				tmi.Error <- errors.New("send channel closed")
-				return
-			}
-			if tmi.socket == nil {
-				tmi.Error <- errors.New("no socket to write to")
-				return
-			}
-			if s == "" {
-				continue
-			}
-			if tmi.Debug {
-				dbg.Printf("> %s\n", s)
+		case line = <-tmi.control:
+			chat = false
+		default:
+			// Lines left by a previous session go before the rest of the chat lane
+			select {
+			case line = <-tmi.control:
+				chat = false
+			case line = <-tmi.retry:
+			default:
+				select {
+				case line = <-tmi.control:
+					chat = false
+				case line = <-tmi.retry:
+				case line = <-tmi.chat:
+				case <-s.end:
+					return
+				}
 			}
-			tmi.socket.SetWriteDeadline(time.Now().Add(tmi.Timeout))
-			_, err := fmt.Fprintf(tmi.socket, "%s\r\n", s)
-			var zero time.Time
-			tmi.socket.SetWriteDeadline(zero)
-
-			if err != nil {
-				tmi.Error <- err
-				return
+		}
+		if chat && !tmi.limit(s, line) {
+			// Leave the line to the next session's writeLoop
+			select {
+			case tmi.retry <- line:
+			default:
+				log.Printf("Dropped %q, the session ended while rate limited\n", line)
 			}
-		case <-tmi.end:
+			return
+		}
+		if line == "" {
+			continue
+		}
+		if err := tmi.write(s, line); err != nil {
+			s.fail(err)
 			return
 		}
 	}
 }
 
+// Write a single line to the session's socket
+func (tmi *Connection) write(s *session, line string) error {
+	if tmi.Debug {
+		dbg.Printf("> %s\n", line)
+	}
+	s.socket.SetWriteDeadline(time.Now().Add(tmi.Timeout))
+	_, err := fmt.Fprintf(s.socket, "%s\r\n", line)
+	var zero time.Time
+	s.socket.SetWriteDeadline(zero)
+	return err
+}
+
 // The pingloop sends automatic, slightly higher frequency, pings
 // to allow a shorter read timeout and disconnect detection.
 // It skips unnecessary pings in case the last received message
 // is within the KeepAlive timeframe
-func (tmi *Connection) pingLoop() {
+func (tmi *Connection) pingLoop(s *session) {
 	defer func() {
 		log.Println("Pinger stopped")
-		tmi.Done()
+		s.Done()
 	}()
 	ticker := time.NewTicker(tmi.Timeout) // Tick for monitoring
 	for {
 		select {
 		case _, ok := <-ticker.C:
 			if !ok {
-				// The ticker has been closed, probably shouldn't happen before tmi.end is closed
+				// The ticker has been closed, probably shouldn't happen before s.end is closed
 				log.Println("ticker not ok")
 				return
 			}
 
-			//Ping if we haven't received anything from the server within the keep alive period
-			if time.Since(tmi.lastMessage) >= tmi.KeepAlive {
-				tmi.Sendf("PING %d", time.Now().UnixNano())
+			// Ping if we haven't received anything from the server within the keep alive period
+			last := time.Unix(0, atomic.LoadInt64(&s.lastMessage))
+			if time.Since(last) >= tmi.KeepAlive {
+				// Written directly like PONG, so a full queue or the outgoing middleware
+				// can't hold up or drop the keepalive, or keep this session from closing
+				if err := tmi.write(s, fmt.Sprintf("PING %d", time.Now().UnixNano())); err != nil {
+					ticker.Stop()
+					s.fail(err)
+					return
+				}
 			}
-		case <-tmi.end:
+		case <-s.end:
 			ticker.Stop()
 			return
 		}
 	}
 }
 
-// The control loop manages disconnection if one of the other loops
-// sends an error on the tmi.Error channel
-// That way, the loops can just send an error and quit without caring about other routines
+// The control loop manages the connection's sessions,
+// reconnecting or disconnecting when one of the session's loops fails.
+// That way, the loops can just report an error and quit without caring about other routines.
+// It owns tmi.session once started, and closes MessageChan when it terminates.
+// The session, MessageChan and end channel are kept in locals, since a new Connect may replace them
+// as soon as the connection is stopped.
 func (tmi *Connection) controlLoop() {
-	for !tmi.Stopped() {
-		err := <-tmi.Error
-		if tmi.Stopped() {
-			// If one of the goroutines errors when we've already stopped,
-			// There's no need to handle the error.
-			continue
-		}
-		log.Printf("Error, disconnecting: %s\n", err)
+	s, messages, end := tmi.session, tmi.MessageChan, tmi.end
+	defer func() {
+		s.close()
+		close(messages)
+		dbg.Println("Disconnected!")
+		log.Println("controlloop terminated")
 		tmi.Done()
-		log.Println("controlLoop done, waiting for disconnect")
-		tmi.Disconnect()
+	}()
+	for {
+		select {
+		case <-s.reconnect:
+			tmi.migrate()
+			s = tmi.session
+		case err := <-s.failed:
+			s.close()
+			// Pass the error on to anyone listening, without blocking
+			select {
+			case tmi.Error <- err:
+			default:
+			}
+			if tmi.AutoReconnect == nil {
+				log.Printf("Error, disconnecting: %s\n", err)
+				tmi.stop()
+				return
+			}
+			log.Printf("Error, reconnecting: %s\n", err)
+			reconnected := tmi.reconnect(err)
+			s = tmi.session
+			if !reconnected {
+				tmi.stop()
+				return
+			}
+		case <-end:
+			return
+		}
+	}
+}
+
+// Activate a session returned by newSession, delivering the messages it has held
+// and starting its write and ping loops.
+// Held messages that the old session already delivered are skipped.
+func (tmi *Connection) activate(s *session, old *session) {
+	var skip map[string]bool
+	if old != nil {
+		skip = old.delivered
+	}
+	atomic.StoreInt64(&s.lastMessage, time.Now().UnixNano())
+	s.Add(3)
+	go func() {
+		defer s.Done()
+		for {
+			s.Lock()
+			if len(s.pending) == 0 {
+				// Caught up, the readLoop delivers from here on
+				s.pending = nil
+				s.held = false
+				s.Unlock()
+				return
+			}
+			held := s.pending[0]
+			s.pending = s.pending[1:]
+			s.Unlock()
+			if skip[held.key] {
+				continue
+			}
+			select {
+			case tmi.MessageChan <- held.message:
+			case <-s.end:
+				return
+			}
+		}
+	}()
+	go tmi.writeLoop(s)
+	go tmi.pingLoop(s)
+}
+
+// Handle the messages that the connection itself needs to act on
+func (tmi *Connection) handle(s *session, m *Message) {
+	switch m.Command {
+	case "001", "GLOBALUSERSTATE":
+		s.login(nil)
+	case "NOTICE":
+		if len(m.Params) == 0 {
+			return
+		}
+		if m.Params[0] == "*" {
+			if err, ok := loginErrors[m.Trailing]; ok {
+				s.login(err)
+			}
+		} else if err, ok := joinErrors[m.Tag("msg-id")]; ok {
+			// Don't try joining the channel again when reconnecting
+			tmi.Lock()
+			delete(tmi.channels, m.Params[0])
+			tmi.Unlock()
+			tmi.joins.done(m.Params[0], err)
+		}
+	case "366":
+		// :sunsbot.tmi.twitch.tv 366 sunsbot #sunspots :End of /NAMES list
+		if len(m.Params) > 1 {
+			tmi.joins.done(m.Params[1], nil)
+		}
+	case "CAP":
+		// :tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands
+		if len(m.Params) < 2 {
+			return
+		}
+		s.Lock()
+		for _, c := range strings.Fields(m.Trailing) {
+			switch m.Params[1] {
+			case "ACK":
+				s.caps[c] = true
+			case "NAK":
+				log.Printf("Capability %s was rejected by the server\n", c)
+				delete(s.caps, c)
+			}
+		}
+		s.Unlock()
+	case "USERSTATE":
+		if tmi.limiter != nil && len(m.Params) > 0 {
+			tmi.limiter.elevate(m.Params[0], elevated(m))
+		}
+	case "RECONNECT":
+		select {
+		case s.reconnect <- true:
+		default:
+		}
+	}
+}
+
+// Record the outcome of the login, only the first one counts
+func (s *session) login(err error) {
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-s.authed:
+	default:
+		s.authErr = err
+		close(s.authed)
+	}
+}
+
+// Deliver a message received by the session to MessageChan, or hold it if the session
+// isn't delivering yet. Returns false if the session ended while delivering.
+func (tmi *Connection) deliver(s *session, raw string, m *Message) bool {
+	key := m.Tag("id")
+	if key == "" {
+		key = strings.TrimSpace(raw)
+	}
+	s.Lock()
+	if s.held {
+		s.pending = append(s.pending, heldMessage{key, m})
+		if m.Command == "366" && len(m.Params) > 1 && s.joining[m.Params[1]] {
+			delete(s.joining, m.Params[1])
+			if len(s.joining) == 0 {
+				close(s.ready)
+			}
+		}
+		s.Unlock()
+		return true
+	}
+	s.Unlock()
+
+	select {
+	case tmi.MessageChan <- m:
+	case <-s.end:
+		return false
+	}
+	s.Lock()
+	if s.delivered != nil {
+		s.delivered[key] = true
+	}
+	s.Unlock()
+	return true
+}
+
+// Report an error from one of the session's loops, only the first one is kept.
+// Errors caused by the session being torn down aren't reported at all.
+func (s *session) fail(err error) {
+	select {
+	case <-s.end:
+		return
+	default:
+	}
+	select {
+	case s.failed <- err:
+	default:
+	}
+}
+
+// Tear down the session, closing the socket and waiting for its loops to finish.
+// Safe to call more than once.
+func (s *session) close() {
+	select {
+	case <-s.end:
+	default:
+		close(s.end)
 	}
-	log.Println("controlloop terminated")
+	// Closing the socket unblocks a pending read in the readLoop
+	s.socket.Close()
+	s.Wait()
 }
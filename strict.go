@@ -0,0 +1,172 @@
+package tmi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors reported by ParseMessageStrict, wrapped in a *ParseError
+var (
+	ErrEmptyMessage    = errors.New("empty message")
+	ErrMissingCommand  = errors.New("missing command")
+	ErrInvalidCommand  = errors.New("invalid command")
+	ErrMalformedTag    = errors.New("malformed tag")
+	ErrMalformedPrefix = errors.New("malformed prefix")
+	ErrEmptyParam      = errors.New("empty param")
+	ErrMalformedEmotes = errors.New("malformed emotes tag")
+)
+
+// ParseError describes why and where a message failed to parse in strict mode
+type ParseError struct {
+	Raw string // The raw message
+	Pos int    // Byte position in Raw where the error was found
+	Err error  // One of the Err* parse errors
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("tmi: %s at position %d", e.Err, e.Pos)
+}
+
+// Unwrap allows errors.Is(err, tmi.ErrMalformedTag) and friends
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseMessageStrict parses a message like ParseMessage, but rejects anything malformed,
+// with a *ParseError telling what is wrong and where
+func ParseMessageStrict(raw string) (*Message, error) {
+	fail := func(pos int, err error) (*Message, error) {
+		return nil, &ParseError{Raw: raw, Pos: pos, Err: err}
+	}
+	// Positions are reported in raw, before trimming
+	position := len(raw) - len(strings.TrimLeft(raw, " \t\r\n"))
+	line := strings.TrimRight(raw, " \t\r\n")
+	if position >= len(line) {
+		return fail(position, ErrEmptyMessage)
+	}
+
+	if line[position] == prefixTags {
+		end := strings.IndexByte(line[position:], space)
+		if end < 0 {
+			return fail(len(line), ErrMissingCommand)
+		}
+		if pos, err := validateTags(line[position+1:position+end], position+1); err != nil {
+			return fail(pos, err)
+		}
+		position += end + 1
+	}
+
+	if line[position] == prefix {
+		end := strings.IndexByte(line[position:], space)
+		if end < 0 {
+			return fail(len(line), ErrMissingCommand)
+		}
+		if end == 1 {
+			return fail(position, ErrMalformedPrefix)
+		}
+		position += end + 1
+	}
+
+	// Commands are letters, or a three digit numeric
+	end := strings.IndexByte(line[position:], space)
+	if end < 0 {
+		end = len(line) - position
+	}
+	if pos, ok := validateCommand(line[position:position+end], position); !ok {
+		return fail(pos, ErrInvalidCommand)
+	}
+	position += end
+
+	// Params are separated by a single space, up to the trailing
+	for position < len(line) && line[position] == space {
+		position++
+		if position == len(line) || line[position] == space {
+			return fail(position, ErrEmptyParam)
+		}
+		if line[position] == prefix {
+			break
+		}
+		for position < len(line) && line[position] != space {
+			position++
+		}
+	}
+
+	return ParseMessage(raw), nil
+}
+
+// Check the tags, reporting the position of the first malformed one
+func validateTags(tags string, offset int) (int, error) {
+	position := 0
+	for _, tag := range strings.Split(tags, string(tagSep)) {
+		key, value := tag, ""
+		hasValue := false
+		if i := strings.IndexByte(tag, tagAss); i >= 0 {
+			key, value, hasValue = tag[:i], tag[i+1:], true
+		}
+		if !validTagKey(key) {
+			return offset + position, ErrMalformedTag
+		}
+		if hasValue {
+			valuePos := offset + position + len(key) + 1
+			// A lone backslash at the end isn't a valid escape
+			escaped := false
+			for i := 0; i < len(value); i++ {
+				if escaped {
+					escaped = false
+				} else if value[i] == '\\' {
+					escaped = true
+				}
+			}
+			if escaped {
+				return valuePos + len(value) - 1, ErrMalformedTag
+			}
+			if key == "emotes" && value != "" {
+				if _, pos, err := parseEmotes(value); err != nil {
+					return valuePos + pos, err
+				}
+			}
+		}
+		position += len(tag) + 1
+	}
+	return 0, nil
+}
+
+// Tag keys are an optional client prefix +, an optional vendor and a name
+func validTagKey(key string) bool {
+	key = strings.TrimPrefix(key, "+")
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '/' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Check a command, returning the position of the first invalid character
+func validateCommand(command string, offset int) (int, bool) {
+	if command == "" {
+		return offset, false
+	}
+	if command[0] >= '0' && command[0] <= '9' {
+		if len(command) != 3 {
+			return offset, false
+		}
+		for i := 0; i < len(command); i++ {
+			if command[i] < '0' || command[i] > '9' {
+				return offset + i, false
+			}
+		}
+		return 0, true
+	}
+	for i := 0; i < len(command); i++ {
+		if c := command[i]; !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return offset + i, false
+		}
+	}
+	return 0, true
+}
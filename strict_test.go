@@ -0,0 +1,132 @@
+package tmi
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testStrictErrors = map[string]ParseError{
+	"":                          {Pos: 0, Err: ErrEmptyMessage},
+	" \r\n":                     {Pos: 3, Err: ErrEmptyMessage},
+	"@a=b":                      {Pos: 4, Err: ErrMissingCommand},
+	":poopie":                   {Pos: 7, Err: ErrMissingCommand},
+	"@a=b :poopie":              {Pos: 12, Err: ErrMissingCommand},
+	": PRIVMSG #sunspots":       {Pos: 0, Err: ErrMalformedPrefix},
+	"@a=b;;c=d PING":            {Pos: 5, Err: ErrMalformedTag},
+	"@=b PING":                  {Pos: 1, Err: ErrMalformedTag},
+	"@a=b;c d=e PING":           {Pos: 8, Err: ErrInvalidCommand},
+	"@a=b\\ PING":               {Pos: 4, Err: ErrMalformedTag},
+	"@a=b\\\\;c=\\ PING":        {Pos: 9, Err: ErrMalformedTag},
+	"@emotes=25 PING":           {Pos: 8, Err: ErrMalformedEmotes},
+	"@emotes=25:0-4,5 PING":     {Pos: 15, Err: ErrMalformedEmotes},
+	"@emotes=25:4-0 PING":       {Pos: 11, Err: ErrMalformedEmotes},
+	"@emotes=25:0-4/1:x-2 PING": {Pos: 17, Err: ErrMalformedEmotes},
+	"\\s":                       {Pos: 0, Err: ErrInvalidCommand},
+	"PRIV*MSG":                  {Pos: 4, Err: ErrInvalidCommand},
+	"0001 sunsbot":              {Pos: 0, Err: ErrInvalidCommand},
+	"PRIVMSG #a  :hi":           {Pos: 11, Err: ErrEmptyParam},
+	"  PRIVMSG  #a":             {Pos: 10, Err: ErrEmptyParam},
+}
+
+func TestParseMessageStrict(t *testing.T) {
+	for raw, expected := range testStrictErrors {
+		m, err := ParseMessageStrict(raw)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("Expected a *ParseError for %q, got %v and %v", raw, m, err)
+			continue
+		}
+		if perr.Pos != expected.Pos || !errors.Is(err, expected.Err) || perr.Raw != raw {
+			t.Errorf("Unexpected error for %q: %v, expected %v at %d", raw, err, expected.Err, expected.Pos)
+		}
+	}
+
+	// Well formed messages parse the same as with ParseMessage
+	for raw, p := range testMessages {
+		m, err := ParseMessageStrict(raw)
+		if p == nil {
+			if err == nil {
+				t.Errorf("Expected an error for %q", raw)
+			}
+			continue
+		}
+		if _, malformed := testStrictErrors[raw]; malformed {
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed parsing %q: %v", raw, err)
+			continue
+		}
+		m.ParseEmotes()
+		if !reflect.DeepEqual(m, p) {
+			t.Errorf("Failed parsing message: %q", raw)
+		}
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for raw := range testMessages {
+		f.Add(raw)
+	}
+	for raw := range testStrictErrors {
+		f.Add(raw)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		m := ParseMessage(raw)
+		strict, err := ParseMessageStrict(raw)
+		if err == nil && (m == nil || strict == nil) {
+			t.Fatalf("%q parsed in strict mode only", raw)
+		}
+		if m == nil {
+			return
+		}
+		// None of these should panic on whatever the parser let through
+		m.ParseEmotes()
+		m.ParseCheers()
+		m.Fragments()
+		m.Typed()
+		m.Badges()
+		m.IsSubscriber()
+		m.SubscriberMonths()
+		m.Channel()
+		_ = m.String()
+		_ = m.Raw()
+
+		into := AcquireMessage()
+		defer ReleaseMessage(into)
+		if !ParseMessageInto(into, raw) {
+			t.Fatalf("%q parsed with ParseMessage only", raw)
+		}
+		into.LoadTags()
+	})
+}
+
+func FuzzParseEmotes(f *testing.F) {
+	f.Add("25:0-4/1902:12-16/30259:23-29,31-37")
+	f.Add("25")
+	f.Add("25:0-4,")
+	f.Add("/:-/")
+	f.Fuzz(func(t *testing.T, s string) {
+		emotes := ParseEmotes(s)
+		SetEmoteOffsets("Kappa \U0001F600 Keepo", emotes)
+		for _, e := range emotes {
+			if e.From < 0 || e.To < e.From {
+				t.Fatalf("Invalid emote %+v from %q", e, s)
+			}
+		}
+	})
+}
+
+func FuzzTags(f *testing.F) {
+	f.Add("display-name=Sun\\sSpots;flag;emotes=")
+	f.Add("a=\\")
+	f.Add(";;=;")
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, v := range ParseTags(s) {
+			if u := UnescapeTag(EscapeTag(v)); u != v {
+				t.Fatalf("Tag value %q didn't round trip, got %q", v, u)
+			}
+		}
+	})
+}
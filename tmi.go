@@ -2,16 +2,36 @@
 package tmi
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
 var (
 	dbg = log.New(os.Stdout, "TMI: ", log.LstdFlags)
+
+	// ErrStopped is returned when using a Connection that is stopped
+	ErrStopped = errors.New("connection is stopped")
+	// ErrAuthFailed is returned when connecting, if the server rejects the username or token
+	ErrAuthFailed = errors.New("login authentication failed")
+	// ErrImproperlyFormattedAuth is returned when connecting, if the server can't make sense of the token
+	ErrImproperlyFormattedAuth = errors.New("improperly formatted auth")
+	// ErrLoginTimeout is returned when connecting, if the server doesn't answer the login in time
+	ErrLoginTimeout = errors.New("timed out waiting for login")
+
+	// NOTICE messages the server answers a failed login with
+	loginErrors = map[string]error{
+		"Login authentication failed": ErrAuthFailed,
+		"Login unsuccessful":          ErrAuthFailed,
+		"Improperly formatted auth":   ErrImproperlyFormattedAuth,
+	}
 )
 
 const (
@@ -21,14 +41,99 @@ const (
 	timeout = 15 * time.Second
 	// Default keepalive
 	keepAlive = 30 * time.Millisecond
+	// DefaultPort is the plaintext port of the TMI server
+	DefaultPort = "6667"
+	// DefaultTLSPort is the TLS port of the TMI server
+	DefaultTLSPort = "6697"
+
+	// CapTags adds IRCv3 tags to messages
+	CapTags = "twitch.tv/tags"
+	// CapCommands enables Twitch specific commands, like USERNOTICE and CLEARCHAT
+	CapCommands = "twitch.tv/commands"
+	// CapMembership enables JOIN and PART messages for other users
+	CapMembership = "twitch.tv/membership"
 )
 
 // Send sends messages to the TMI server
 func (tmi *Connection) Send(s string) {
-	if !tmi.Stopped() {
-		tmi.send <- s
-	} else {
-		dbg.Printf("unable to send %s on closed connection \n", s)
+	if err := tmi.SendContext(context.Background(), s); err != nil {
+		dbg.Printf("unable to send %s: %s\n", s, err)
+	}
+}
+
+// SendContext sends a message to the TMI server, giving up if ctx is done
+// before the message could be queued.
+// Control messages like PING, JOIN and PART are queued separately from chat messages,
+// and sent ahead of them. With the SendDrop policy, ErrSendQueueFull is returned
+// instead of waiting for room in the queue.
+// Messages pass through the outgoing middleware chain first, see UseOutgoing.
+func (tmi *Connection) SendContext(ctx context.Context, s string) error {
+	lines, err := tmi.runOutgoing(s)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if err = tmi.enqueue(ctx, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queue a line for the writeLoop
+func (tmi *Connection) enqueue(ctx context.Context, s string) error {
+	tmi.Lock()
+	stopped, end := tmi.stopped, tmi.end
+	var lane chan string
+	if !stopped {
+		lane = tmi.lane(s)
+	}
+	tmi.Unlock()
+	if stopped {
+		return ErrStopped
+	}
+	if tmi.SendPolicy == SendDrop {
+		select {
+		case lane <- s:
+			tmi.track(s)
+			return nil
+		default:
+			return ErrSendQueueFull
+		}
+	}
+	select {
+	case lane <- s:
+		tmi.track(s)
+		return nil
+	case <-end:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Keep track of joined channels, so they can be rejoined when reconnecting
+func (tmi *Connection) track(s string) {
+	var joined bool
+	switch {
+	case strings.HasPrefix(s, "JOIN "):
+		joined = true
+	case strings.HasPrefix(s, "PART "):
+	default:
+		return
+	}
+	fields := strings.Fields(s[5:])
+	if len(fields) == 0 {
+		return
+	}
+	tmi.Lock()
+	defer tmi.Unlock()
+	for _, channel := range strings.Split(fields[0], ",") {
+		if joined {
+			tmi.channels[channel] = true
+		} else {
+			delete(tmi.channels, channel)
+		}
 	}
 }
 
@@ -37,11 +142,6 @@ func (tmi *Connection) Sendf(format string, a ...interface{}) {
 	tmi.Send(fmt.Sprintf(format, a...))
 }
 
-// Join simply sends a join message
-func (tmi *Connection) Join(channel string) {
-	tmi.Send("JOIN " + channel)
-}
-
 // Stopped tells us wether the client is stopped or not
 func (tmi *Connection) Stopped() bool {
 	tmi.Lock()
@@ -49,36 +149,54 @@ func (tmi *Connection) Stopped() bool {
 	return tmi.stopped
 }
 
-// Update the stopped status when starting or stopping the client
-func (tmi *Connection) setStopped(value bool) {
+// Mark the client as stopped, signalling all routines to end.
+// Returns false if it was already stopped.
+func (tmi *Connection) stop() bool {
 	tmi.Lock()
-	tmi.stopped = value
-	tmi.Unlock()
+	defer tmi.Unlock()
+	if tmi.stopped {
+		return false
+	}
+	tmi.stopped = true
+	close(tmi.end)
+	tmi.cancel()
+	return true
 }
 
 // ReadMessage reads an incoming message from the server,
 // blocking until a message is recieved or an error occurs
 func (tmi *Connection) ReadMessage() (*Message, error) {
-	evt, ok := <-tmi.MessageChan
-	var err error
-	if !ok {
-		err = errors.New("read message channel closed")
+	return tmi.ReadMessageContext(context.Background())
+}
+
+// ReadMessageContext reads an incoming message from the server,
+// blocking until a message is recieved, an error occurs or ctx is done.
+// Messages pass through the middleware chain first, see Use.
+func (tmi *Connection) ReadMessageContext(ctx context.Context) (*Message, error) {
+	for {
+		if r, ok := tmi.nextUnread(); ok {
+			return r.message, r.err
+		}
+		select {
+		case evt, ok := <-tmi.MessageChan:
+			if !ok {
+				return nil, errors.New("read message channel closed")
+			}
+			if r, ok := tmi.runMiddleware(evt); ok {
+				return r.message, r.err
+			}
+			// Dropped by the middleware, wait for the next one
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	return evt, err
 }
 
 // Disconnect from the server
 func (tmi *Connection) Disconnect() {
-	if !tmi.Stopped() {
-		tmi.setStopped(true)
-		close(tmi.end)
-		tmi.Wait()
-		close(tmi.send)
-		tmi.socket.Close()
-		tmi.socket = nil
-		close(tmi.MessageChan)
-		dbg.Println("Disconnected!")
-	}
+	tmi.stop()
+	// The controlLoop tears down the session and closes MessageChan
+	tmi.Wait()
 }
 
 // Reconnect to a connected server
@@ -87,59 +205,249 @@ func (tmi *Connection) Reconnect() error {
 	return tmi.Connect()
 }
 
-// Connect connects to the server, starts routines and authenticates
+// Connect connects to the server, starts routines and authenticates.
+// It waits for the server to accept the login, returning ErrAuthFailed or
+// ErrImproperlyFormattedAuth if it doesn't.
+// Channels that were joined before disconnecting are joined again.
 func (tmi *Connection) Connect() (err error) {
-	if !tmi.stopped {
+	return tmi.ConnectContext(context.Background())
+}
+
+// ConnectContext connects like Connect, giving up if ctx is done before connected.
+// Once connected, ctx has no effect on the connection.
+func (tmi *Connection) ConnectContext(ctx context.Context) (err error) {
+	if !tmi.Stopped() {
 		return errors.New("Can't attempt to Connect with a Connection that isn't stopped!")
 	}
+	// The previous connection's loops may still be cleaning up after stopping
+	tmi.Wait()
 
-	if len(tmi.Token) > 0 && tmi.Token[0:6] == "oauth:" {
-		tmi.Token = tmi.Token[6:]
+	tmi.Token = strings.TrimPrefix(tmi.Token, "oauth:")
+	tmi.limiter = nil
+	if tmi.RateLimits != nil {
+		tmi.limiter = newLimiter(*tmi.RateLimits)
 	}
 
-	tmi.socket, err = net.DialTimeout("tcp", tmi.Server+":"+tmi.Port, tmi.Timeout)
+	s, err := tmi.newSession(ctx)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Connected to TMI server %s (%s)\n", tmi.Server, tmi.socket.RemoteAddr())
+	// Drop errors left over from a previous connection
+	for len(tmi.Error) > 0 {
+		<-tmi.Error
+	}
 	tmi.Lock()
 	tmi.end = make(chan bool)
-	tmi.send = make(chan string, 10)
+	tmi.ctx, tmi.cancel = context.WithCancel(context.Background())
+	size := tmi.SendQueueSize
+	if size <= 0 {
+		size = sendQueueSize
+	}
+	tmi.control = make(chan string, size)
+	tmi.chat = make(chan string, size)
+	tmi.retry = make(chan string, 1)
 	tmi.MessageChan = make(chan *Message, 50)
+	tmi.session = s
 	tmi.stopped = false
 	tmi.Unlock()
-	tmi.Add(4)
-	go tmi.readLoop()
-	go tmi.writeLoop()
-	go tmi.pingLoop()
+	tmi.activate(s, nil)
+	tmi.Add(2)
 	go tmi.controlLoop()
+	go tmi.joinLoop()
+	return nil
+}
 
-	//Authenticate
+// Dial the server and authenticate a new session, then join any tracked channels.
+// The lines are written directly, so they go out before anything queued with Send.
+// The session is returned once logged in, reading but holding its messages until activated.
+func (tmi *Connection) newSession(ctx context.Context) (*session, error) {
+	socket, err := tmi.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Interrupt the writes below if ctx is done
+	stop := context.AfterFunc(ctx, func() { socket.SetDeadline(time.Now()) })
+	log.Printf("Connected to TMI server %s (%s)\n", tmi.Server, socket.RemoteAddr())
+	s := &session{
+		socket:    socket,
+		end:       make(chan bool),
+		failed:    make(chan error, 1),
+		reconnect: make(chan bool, 1),
+		held:      true,
+		joining:   make(map[string]bool),
+		ready:     make(chan bool),
+		authed:    make(chan bool),
+		caps:      make(map[string]bool),
+	}
 
+	//Authenticate
+	var lines []string
 	if len(tmi.Token) != 0 {
-		tmi.Send("PASS oauth:" + tmi.Token)
+		lines = append(lines, "PASS oauth:"+tmi.Token)
+	}
+	lines = append(lines, "NICK "+tmi.Username)
+	if len(tmi.Capabilities) > 0 {
+		lines = append(lines, "CAP REQ :"+strings.Join(tmi.Capabilities, " "))
+	}
+	for _, line := range lines {
+		if err = tmi.write(s, line); err != nil {
+			break
+		}
+	}
+	if !stop() {
+		// Report the cancellation rather than the interrupted write
+		err = ctx.Err()
+	}
+	if err != nil {
+		socket.Close()
+		return nil, err
 	}
+	// Keep interrupting the rest of the login, until it's done
+	stop = context.AfterFunc(ctx, func() { socket.SetDeadline(time.Now()) })
 
-	tmi.Send("NICK " + tmi.Username)
-	tmi.Send("CAP REQ :twitch.tv/tags twitch.tv/commands")
+	s.Add(1)
+	go tmi.readLoop(s)
+	timer := time.NewTimer(tmi.Timeout)
+	defer timer.Stop()
+	select {
+	case <-s.authed:
+		err = s.authErr
+	case err = <-s.failed:
+		// The server usually hangs up right after a failed login
+		select {
+		case <-s.authed:
+			if s.authErr != nil {
+				err = s.authErr
+			}
+		default:
+		}
+	case <-timer.C:
+		err = ErrLoginTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = tmi.rejoin(ctx, s)
+	}
+	if !stop() {
+		// Report the cancellation rather than the interrupted write
+		err = ctx.Err()
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
 
-	return nil
+// EnabledCapabilities returns the capabilities the server has acknowledged on the current connection
+func (tmi *Connection) EnabledCapabilities() []string {
+	tmi.Lock()
+	s := tmi.session
+	tmi.Unlock()
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	caps := make([]string, 0, len(s.caps))
+	for c := range s.caps {
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// HasCapability tells us wether the server has acknowledged a capability on the current connection
+func (tmi *Connection) HasCapability(capability string) bool {
+	for _, c := range tmi.EnabledCapabilities() {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// UseTLS enables TLS for the next Connect, using the given config.
+// A nil config uses the system's root CAs, custom root CAs can be set with config.RootCAs.
+// If the port is the default plaintext port, it is switched to the default TLS port.
+func (tmi *Connection) UseTLS(config *tls.Config) {
+	tmi.TLS = true
+	tmi.TLSConfig = config
+	if tmi.Port == DefaultPort {
+		tmi.Port = DefaultTLSPort
+	}
+}
+
+// Open the socket to the server, using the configured Dialer,
+// and perform the TLS handshake on top of it if TLS is enabled
+func (tmi *Connection) dial(ctx context.Context) (net.Conn, error) {
+	port := tmi.Port
+	if port == "" {
+		port = DefaultPort
+	}
+	if tmi.TLS && port == DefaultPort {
+		// TLS was enabled without UseTLS, the plaintext port won't do a handshake
+		port = DefaultTLSPort
+	}
+	var dialer Dialer = &net.Dialer{Timeout: tmi.Timeout}
+	if tmi.Dialer != nil {
+		dialer = tmi.Dialer
+	}
+	conn, err := dialContext(ctx, dialer, "tcp", net.JoinHostPort(tmi.Server, port))
+	if err != nil || !tmi.TLS {
+		return conn, err
+	}
+
+	config := &tls.Config{}
+	if tmi.TLSConfig != nil {
+		config = tmi.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = tmi.Server
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(tmi.Timeout))
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var zero time.Time
+	tlsConn.SetDeadline(zero)
+	return tlsConn, nil
+}
+
+// Dial with the context if the dialer supports it, like *net.Dialer does
+func dialContext(ctx context.Context, dialer Dialer, network, address string) (net.Conn, error) {
+	if d, ok := dialer.(interface {
+		DialContext(context.Context, string, string) (net.Conn, error)
+	}); ok {
+		return d.DialContext(ctx, network, address)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return dialer.Dial(network, address)
 }
 
 // New returns a new connection object, ready to connect
 func New(username, token string) *Connection {
+	limits := DefaultLimits
 	tmi := &Connection{
-		Server:    "irc.chat.twitch.tv",
-		Port:      "6667",
-		Debug:     false,
-		socket:    nil,
-		stopped:   true,
-		Timeout:   timeout,
-		KeepAlive: keepAlive,
-		Error:     make(chan error, 3),
-		Username:  username,
-		Token:     token,
+		Server:       "irc.chat.twitch.tv",
+		Port:         DefaultPort,
+		Debug:        false,
+		stopped:      true,
+		channels:     make(map[string]bool),
+		joins:        newJoinQueue(),
+		Timeout:      timeout,
+		KeepAlive:    keepAlive,
+		Capabilities: []string{CapTags, CapCommands},
+		RateLimits:   &limits,
+		Error:        make(chan error, 3),
+		Username:     username,
+		Token:        token,
 	}
 	return tmi
 }
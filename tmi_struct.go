@@ -1,29 +1,84 @@
 package tmi
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"sync"
 	"time"
 )
 
-//Connection is the main struct for for containing an active connection
+// Connection is the main struct for for containing an active connection
 type Connection struct {
 	sync.WaitGroup
 	sync.Mutex
-	Server      string // Server to connect to
-	Port        string // Port to connect to
-	Username    string // Twitch username to connect with
-	Token       string // OAuth token, without "oauth:" prefix
+	Server      string      // Server to connect to
+	Port        string      // Port to connect to
+	TLS         bool        // TLS decides if the connection is made over TLS, DefaultPort then means DefaultTLSPort
+	TLSConfig   *tls.Config // TLS configuration, nil uses the default configuration
+	Dialer      Dialer      // Dialer opens the underlying stream, nil dials TCP
+	Username    string      // Twitch username to connect with
+	Token       string      // OAuth token, without "oauth:" prefix
 	stopped     bool
 	end         chan bool
-	send        chan string
-	Debug       bool // Debug decides if debug messages should be printed.
+	ctx         context.Context // Cancelled when stopped, to abort reconnection attempts
+	cancel      context.CancelFunc
+	control     chan string // Outgoing control messages, sent before chat
+	chat        chan string // Outgoing chat messages
+	retry       chan string // A chat message taken by a session that ended before sending it
+	Debug       bool        // Debug decides if debug messages should be printed.
 	Error       chan error
-	socket      net.Conn
+	session     *session
+	channels    map[string]bool // Channels to rejoin when reconnecting
+	joins       *joinQueue
 	MessageChan chan *Message
 	Timeout     time.Duration
 	KeepAlive   time.Duration
-	lastMessage time.Time
+	// AutoReconnect enables automatic reconnection when the connection is lost, nil disables it
+	AutoReconnect *ReconnectPolicy
+	callbacks     callbacks // Runs the AutoReconnect callbacks
+	// Capabilities to request when connecting, see CapTags, CapCommands and CapMembership
+	Capabilities []string
+	// RateLimits for outgoing chat messages, nil disables rate limiting
+	RateLimits *Limits
+	limiter    *limiter
+	// SendQueueSize is the capacity of each outgoing queue, 0 uses the default
+	SendQueueSize int
+	// SendPolicy decides what happens when sending to a full queue
+	SendPolicy SendPolicy
+	middleware []MultiMiddleware // Incoming message chain, see Use
+	outgoing   []MultiMiddleware // Outgoing message chain, see UseOutgoing
+	unread     []readResult      // Messages fanned out by the middleware, waiting to be read
+}
+
+// session holds the state of a single socket to the server.
+// A Connection outlives its sessions when reconnecting.
+type session struct {
+	sync.WaitGroup
+	sync.Mutex
+	socket      net.Conn
+	end         chan bool  // Closed when the session is torn down
+	failed      chan error // Receives the first error from one of the session's loops
+	reconnect   chan bool  // Receives when the server asks us to reconnect
+	lastMessage int64      // UnixNano of the last received message, accessed atomically
+	authed      chan bool  // Closed once the server has answered the login
+	authErr     error      // Reason the login failed, if it did
+
+	// Capabilities acknowledged by the server
+	caps map[string]bool
+
+	// State used until the session is activated
+	held      bool            // Hold incoming messages in pending instead of delivering them
+	pending   []heldMessage   // Messages received while held
+	joining   map[string]bool // Channels we're waiting for a 366 on while held
+	ready     chan bool       // Closed once all channels in joining are joined
+	delivered map[string]bool // Keys of delivered messages, recorded when non-nil
+}
+
+// heldMessage is a message received by a session that isn't delivering yet
+type heldMessage struct {
+	key     string // The message id, or the raw line if there is none
+	message *Message
 }
 
 // Connector interface for implementing alternate Connections
@@ -37,3 +92,18 @@ type Connector interface {
 	ReadMessage() (*Message, error)
 	Reconnect() error
 }
+
+// Dialer opens the line-oriented stream that a Connection reads from and writes to.
+// *net.Dialer satisfies it, and so do most proxy dialers.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// DialerFunc is an adapter to allow the use of ordinary functions as a Dialer,
+// for example returning one end of a net.Pipe in tests
+type DialerFunc func(network, address string) (net.Conn, error)
+
+// Dial calls f(network, address)
+func (f DialerFunc) Dial(network, address string) (net.Conn, error) {
+	return f(network, address)
+}
@@ -0,0 +1,601 @@
+package tmi
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal stand-in for the TMI server,
+// recording the lines it receives and writing the lines it's told to.
+// It welcomes every NICK, unless a reply to the login is set.
+type fakeServer struct {
+	conn  net.Conn
+	lines chan string
+}
+
+func newFakeServer(conn net.Conn) *fakeServer {
+	return newFakeServerLogin(conn, "")
+}
+
+func newFakeServerLogin(conn net.Conn, reply string) *fakeServer {
+	s := &fakeServer{conn: conn, lines: make(chan string, 100)}
+	go func() {
+		defer close(s.lines)
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if strings.HasPrefix(line, "NICK ") {
+				if reply == "" {
+					reply = ":tmi.twitch.tv 001 " + line[5:] + " :Welcome, GLHF!"
+				}
+				go conn.Write([]byte(reply + "\r\n"))
+			}
+			s.lines <- line
+		}
+	}()
+	return s
+}
+
+// expect waits for a line starting with prefix, skipping any other lines
+func (s *fakeServer) expect(t *testing.T, prefix string) string {
+	t.Helper()
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				t.Fatalf("connection closed while waiting for %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timer.C:
+			t.Fatalf("timed out waiting for %q", prefix)
+		}
+	}
+}
+
+func (s *fakeServer) write(t *testing.T, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readMessage reads from the connection, skipping the fake server's welcome,
+// failing the test if nothing arrives in time
+func readMessage(t *testing.T, conn *Connection) *Message {
+	t.Helper()
+	for {
+		select {
+		case m, ok := <-conn.MessageChan:
+			if !ok {
+				t.Fatal("message channel closed")
+			}
+			if m.Command == "001" {
+				continue
+			}
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	// Borrow a self-signed certificate from httptest
+	h := httptest.NewTLSServer(nil)
+	cert := h.Certificate()
+	certs := h.TLS.Certificates
+	h.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan *fakeServer, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			// Start reading right away so the handshake can complete
+			accepted <- newFakeServer(c)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn := New("sunsbot", "oauth:token")
+	conn.Server = host
+	conn.UseTLS(&tls.Config{RootCAs: roots, ServerName: "example.com"})
+	if conn.Port != DefaultTLSPort {
+		t.Errorf("expected port %s, got %s", DefaultTLSPort, conn.Port)
+	}
+	conn.Port = port
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var server *fakeServer
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never accepted the connection")
+	}
+	server.expect(t, "PASS oauth:token")
+	server.expect(t, "NICK sunsbot")
+	server.write(t, ":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :over tls")
+	if m := readMessage(t, conn); m.Trailing != "over tls" {
+		t.Errorf("unexpected message %v", m)
+	}
+
+	// Closing the server side should disconnect the client
+	server.conn.Close()
+	for range conn.MessageChan {
+	}
+	if !conn.Stopped() {
+		t.Error("connection not stopped after server closed")
+	}
+}
+
+func TestTLSDefaultPort(t *testing.T) {
+	addresses := make(chan string, 1)
+	conn := New("sunsbot", "oauth:token")
+	conn.TLS = true
+	conn.Dialer = DialerFunc(func(network, address string) (net.Conn, error) {
+		addresses <- address
+		return nil, errors.New("no server")
+	})
+	if err := conn.Connect(); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if address := <-addresses; address != net.JoinHostPort(conn.Server, DefaultTLSPort) {
+		t.Errorf("expected the TLS port, dialled %s", address)
+	}
+}
+
+// pipeConnection returns a Connection dialled over an in-memory pipe, and the server end of it.
+// The setup functions are called before connecting.
+func pipeConnection(t *testing.T, setup ...func(*Connection)) (*Connection, *fakeServer) {
+	t.Helper()
+	servers := make(chan *fakeServer, 1)
+	conn := New("sunsbot", "token")
+	for _, f := range setup {
+		f(conn)
+	}
+	conn.Dialer = DialerFunc(func(network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		servers <- newFakeServer(server)
+		return client, nil
+	})
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return conn, <-servers
+}
+
+func TestPipeDialer(t *testing.T) {
+	conn, server := pipeConnection(t)
+	server.expect(t, "PASS oauth:token")
+	server.expect(t, "NICK sunsbot")
+
+	server.write(t, "PING :tmi.twitch.tv")
+	if line := server.expect(t, "PONG"); line != "PONG tmi.twitch.tv" {
+		t.Errorf("unexpected pong %q", line)
+	}
+
+	server.write(t, ":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :over a pipe")
+	if m := readMessage(t, conn); m.Trailing != "over a pipe" {
+		t.Errorf("unexpected message %v", m)
+	}
+
+	done := make(chan bool)
+	go func() {
+		conn.Disconnect()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Disconnect didn't return")
+	}
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Error("expected an error reading from a disconnected connection")
+	}
+}
+
+func TestAutoReconnect(t *testing.T) {
+	servers := make(chan *fakeServer, 2)
+	conn := New("sunsbot", "token")
+	conn.Dialer = DialerFunc(func(network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		servers <- newFakeServer(server)
+		return client, nil
+	})
+	reconnected := make(chan int, 1)
+	conn.AutoReconnect = &ReconnectPolicy{
+		MinDelay:    time.Millisecond,
+		MaxDelay:    10 * time.Millisecond,
+		MaxAttempts: 3,
+		OnReconnect: func(attempt int) { reconnected <- attempt },
+	}
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	server := <-servers
+	conn.Join("#sunspots")
+	server.expect(t, "JOIN #sunspots")
+
+	// Drop the connection, a new one should be opened and the channel rejoined
+	server.conn.Close()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't reconnect")
+	}
+	server = <-servers
+	server.expect(t, "PASS oauth:token")
+	server.expect(t, "NICK sunsbot")
+	server.expect(t, "CAP REQ")
+	server.expect(t, "JOIN #sunspots")
+
+	server.write(t, ":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :still here")
+	if m := readMessage(t, conn); m.Trailing != "still here" {
+		t.Errorf("unexpected message %v", m)
+	}
+	if conn.Stopped() {
+		t.Error("connection stopped while reconnecting")
+	}
+}
+
+func TestDisconnectFromCallback(t *testing.T) {
+	disconnected := make(chan bool)
+	var conn *Connection
+	conn, server := pipeConnection(t, func(c *Connection) {
+		c.AutoReconnect = &ReconnectPolicy{
+			MinDelay: time.Hour,
+			// Giving up from a callback shouldn't wait on itself
+			OnDisconnect: func(err error) {
+				conn.Disconnect()
+				close(disconnected)
+			},
+		}
+	})
+	server.conn.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Disconnect from OnDisconnect didn't return")
+	}
+	if !conn.Stopped() {
+		t.Error("expected the connection to be stopped")
+	}
+}
+
+func TestConnectAfterDrop(t *testing.T) {
+	servers := make(chan *fakeServer, 1)
+	conn := New("sunsbot", "token")
+	conn.Dialer = DialerFunc(func(network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		servers <- newFakeServer(server)
+		return client, nil
+	})
+	for i := 0; i < 3; i++ {
+		if err := conn.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		server := <-servers
+		server.expect(t, "NICK sunsbot")
+		// Connect again as soon as the dropped connection reports being stopped,
+		// while its loops may still be cleaning up
+		server.conn.Close()
+		for !conn.Stopped() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	server := <-servers
+	server.write(t, ":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :still here")
+	if m := readMessage(t, conn); m.Trailing != "still here" {
+		t.Errorf("unexpected message %v", m)
+	}
+	conn.Disconnect()
+}
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	p := &ReconnectPolicy{MinDelay: time.Second, MaxDelay: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range expected {
+		if got := p.Delay(i + 1); got != d {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, d, got)
+		}
+	}
+}
+
+func TestReconnectCommand(t *testing.T) {
+	conn, server := pipeConnection(t)
+	defer conn.Disconnect()
+	servers := make(chan *fakeServer, 1)
+	conn.Dialer = DialerFunc(func(network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		servers <- newFakeServer(server)
+		return client, nil
+	})
+	conn.Join("#sunspots")
+	server.expect(t, "JOIN #sunspots")
+
+	server.write(t, ":tmi.twitch.tv RECONNECT")
+	if m := readMessage(t, conn); m.Command != "RECONNECT" {
+		t.Fatalf("expected RECONNECT, got %v", m)
+	}
+	next := <-servers
+	next.expect(t, "NICK sunsbot")
+	next.expect(t, "JOIN #sunspots")
+
+	// Both connections deliver the same message, it should only be read once
+	server.write(t, "@id=1 :a!a@a.tmi.twitch.tv PRIVMSG #sunspots :one")
+	if m := readMessage(t, conn); m.Trailing != "one" {
+		t.Errorf("expected one, got %v", m)
+	}
+	next.write(t,
+		"@id=1 :a!a@a.tmi.twitch.tv PRIVMSG #sunspots :one",
+		"@id=2 :b!b@b.tmi.twitch.tv PRIVMSG #sunspots :two",
+		":sunsbot.tmi.twitch.tv 366 sunsbot #sunspots :End of /NAMES list",
+	)
+	if m := readMessage(t, conn); m.Trailing != "two" {
+		t.Errorf("expected two, got %v", m)
+	}
+	if m := readMessage(t, conn); m.Command != "366" {
+		t.Errorf("expected 366, got %v", m)
+	}
+
+	// The old connection is closed, and everything is sent on the new one
+	for range server.lines {
+	}
+	conn.Send("PRIVMSG #sunspots :hello")
+	next.expect(t, "PRIVMSG #sunspots :hello")
+}
+
+func TestContext(t *testing.T) {
+	conn := New("sunsbot", "token")
+	conn.Dialer = DialerFunc(func(network, address string) (net.Conn, error) {
+		// Nobody reads the server end, so writing the login blocks
+		client, _ := net.Pipe()
+		return client, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conn.ConnectContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected ConnectContext to time out, got %v", err)
+	}
+	if !conn.Stopped() {
+		t.Error("connection isn't stopped after failing to connect")
+	}
+
+	conn, server := pipeConnection(t)
+	defer conn.Disconnect()
+	if m, err := conn.ReadMessageContext(context.Background()); err != nil || m.Command != "001" {
+		t.Errorf("expected the welcome message, got %v %v", m, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := conn.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected ReadMessageContext to time out, got %v", err)
+	}
+	if err := conn.SendContext(context.Background(), "PRIVMSG #sunspots :hi"); err != nil {
+		t.Error(err)
+	}
+	server.expect(t, "PRIVMSG #sunspots :hi")
+
+	conn.Disconnect()
+	if err := conn.SendContext(context.Background(), "PRIVMSG #sunspots :hi"); err != ErrStopped {
+		t.Errorf("expected ErrStopped, got %v", err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	replies := map[string]error{
+		":tmi.twitch.tv NOTICE * :Login authentication failed": ErrAuthFailed,
+		":tmi.twitch.tv NOTICE * :Improperly formatted auth":   ErrImproperlyFormattedAuth,
+		":tmi.twitch.tv 001 sunsbot :Welcome, GLHF!":           nil,
+		":tmi.twitch.tv GLOBALUSERSTATE":                       nil,
+	}
+	for reply, expected := range replies {
+		conn := New("sunsbot", "token")
+		conn.Dialer = DialerFunc(func(network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			newFakeServerLogin(server, reply)
+			return client, nil
+		})
+		if err := conn.Connect(); err != expected {
+			t.Errorf("%q: expected %v, got %v", reply, expected, err)
+		}
+		if stopped := conn.Stopped(); stopped != (expected != nil) {
+			t.Errorf("%q: expected stopped to be %v", reply, expected != nil)
+		}
+		conn.Disconnect()
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	conn, server := pipeConnection(t)
+	defer conn.Disconnect()
+	if line := server.expect(t, "CAP REQ"); line != "CAP REQ :twitch.tv/tags twitch.tv/commands" {
+		t.Errorf("unexpected capability request %q", line)
+	}
+	server.write(t,
+		":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands",
+		":tmi.twitch.tv CAP * NAK :twitch.tv/commands",
+	)
+	readMessage(t, conn)
+	readMessage(t, conn)
+	if caps := conn.EnabledCapabilities(); len(caps) != 1 || caps[0] != CapTags {
+		t.Errorf("expected only %s to be enabled, got %v", CapTags, caps)
+	}
+	if !conn.HasCapability(CapTags) || conn.HasCapability(CapMembership) {
+		t.Error("HasCapability doesn't match the acknowledged capabilities")
+	}
+}
+
+func TestJoinAll(t *testing.T) {
+	conn, server := pipeConnection(t)
+	defer conn.Disconnect()
+
+	results := make(chan []JoinResult)
+	go func() {
+		results <- conn.JoinAll(context.Background(), "Sunspots", "#suspended", "#sunspots")
+	}()
+	// Joins are batched in a single line
+	if line := server.expect(t, "JOIN"); line != "JOIN #sunspots,#suspended" {
+		t.Errorf("unexpected join %q", line)
+	}
+	server.write(t,
+		":sunsbot.tmi.twitch.tv 366 sunsbot #sunspots :End of /NAMES list",
+		"@msg-id=msg_channel_suspended :tmi.twitch.tv NOTICE #suspended :This channel has been suspended.",
+	)
+	expected := []JoinResult{{"#sunspots", nil}, {"#suspended", ErrChannelSuspended}, {"#sunspots", nil}}
+	select {
+	case r := <-results:
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("expected %v, got %v", expected, r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("JoinAll didn't return")
+	}
+	conn.Lock()
+	if !conn.channels["#sunspots"] || conn.channels["#suspended"] {
+		t.Errorf("expected only #sunspots to be rejoined, got %v", conn.channels)
+	}
+	conn.Unlock()
+}
+
+func TestJoinAllTimeout(t *testing.T) {
+	conn, server := pipeConnection(t)
+	defer conn.Disconnect()
+
+	// The server doesn't answer for channels that don't exist
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := conn.JoinAll(ctx, "#doesnotexist")
+	server.expect(t, "JOIN #doesnotexist")
+	if len(r) != 1 || r[0].Err != context.DeadlineExceeded {
+		t.Errorf("expected a deadline error, got %v", r)
+	}
+	conn.joins.Lock()
+	if len(conn.joins.waiting) != 0 {
+		t.Errorf("expected nothing to wait on the answer, got %v", conn.joins.waiting)
+	}
+	conn.joins.Unlock()
+}
+
+func TestJoinRateLimit(t *testing.T) {
+	conn, server := pipeConnection(t, func(conn *Connection) {
+		conn.RateLimits = &Limits{Join: RateLimit{Messages: 2, Per: time.Hour}}
+	})
+	defer conn.Disconnect()
+	conn.Join("#a")
+	conn.Join("#b")
+	conn.Join("#c")
+	if line := server.expect(t, "JOIN"); line != "JOIN #a,#b" && line != "JOIN #a" {
+		t.Errorf("unexpected join %q", line)
+	}
+	select {
+	case line := <-server.lines:
+		if strings.Contains(line, "#c") {
+			t.Errorf("joined #c above the rate limit: %q", line)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	conn, server := pipeConnection(t, func(conn *Connection) {
+		conn.Timeout = 200 * time.Millisecond
+		conn.KeepAlive = 10 * time.Millisecond
+		// Keepalives don't go through the outgoing middleware
+		conn.UseOutgoing(func(m *Message, err error) (*Message, error) {
+			return nil, err
+		})
+	})
+	defer conn.Disconnect()
+	server.expect(t, "PING ")
+}
+
+func TestRateLimitedReconnect(t *testing.T) {
+	servers := make(chan *fakeServer, 2)
+	conn := New("sunsbot", "token")
+	conn.RateLimits = &Limits{User: RateLimit{Messages: 1, Per: 300 * time.Millisecond}}
+	conn.AutoReconnect = &ReconnectPolicy{MinDelay: time.Millisecond}
+	conn.Dialer = DialerFunc(func(network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		servers <- newFakeServer(server)
+		return client, nil
+	})
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	server := <-servers
+	conn.Send("PRIVMSG #sunspots :one")
+	server.expect(t, "PRIVMSG #sunspots :one")
+
+	// The second message waits for the rate limit when the connection drops,
+	// the next session sends it instead
+	conn.Send("PRIVMSG #sunspots :two")
+	time.Sleep(50 * time.Millisecond)
+	server.conn.Close()
+	server = <-servers
+	server.expect(t, "PRIVMSG #sunspots :two")
+}
+
+func TestSendQueue(t *testing.T) {
+	conn, server := pipeConnection(t, func(conn *Connection) {
+		conn.RateLimits = &Limits{User: RateLimit{Messages: 1, Per: time.Hour}}
+		conn.SendQueueSize = 1
+		conn.SendPolicy = SendDrop
+	})
+	defer conn.Disconnect()
+
+	ctx := context.Background()
+	if err := conn.SendContext(ctx, "PRIVMSG #sunspots :one"); err != nil {
+		t.Fatal(err)
+	}
+	server.expect(t, "PRIVMSG #sunspots :one")
+
+	// The chat lane is stuck behind the rate limit, so it fills up
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = conn.SendContext(ctx, "PRIVMSG #sunspots :more")
+	}
+	if err != ErrSendQueueFull {
+		t.Errorf("expected ErrSendQueueFull, got %v", err)
+	}
+
+	// Control messages skip ahead of the waiting chat messages
+	if err := conn.SendContext(ctx, "PART #sunspots"); err != nil {
+		t.Fatal(err)
+	}
+	if line := server.expect(t, "P"); line != "PART #sunspots" {
+		t.Errorf("expected the PART before more chat messages, got %q", line)
+	}
+}
@@ -0,0 +1,338 @@
+package tmi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWebSocketURL is Twitch's WebSocket endpoint for TMI
+	DefaultWebSocketURL = "wss://irc-ws.chat.twitch.tv:443"
+
+	// Magic GUID used to compute Sec-WebSocket-Accept, see RFC 6455
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// Largest frame we accept from the peer, TMI messages are much smaller than this
+	wsMaxFrameSize = 1 << 20
+
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xA
+)
+
+// WebSocketDialer opens a WebSocket connection and exposes it as a line stream,
+// so it can be used as a Connection's Dialer.
+// Each line written is sent as a single text message, and incoming messages are
+// read back as CRLF terminated lines.
+type WebSocketDialer struct {
+	URL       string        // ws:// or wss:// URL to connect to
+	TLSConfig *tls.Config   // TLS configuration for wss:// URLs, nil uses the default configuration
+	Header    http.Header   // Extra headers sent with the handshake, ex. Origin
+	Dialer    Dialer        // Dialer for the underlying stream, nil dials TCP
+	Timeout   time.Duration // Timeout for dialing and the handshake, 0 means no timeout
+}
+
+// Dial connects to the dialer's URL and performs the WebSocket handshake.
+// The network and address are ignored, since the URL decides where to connect.
+func (d *WebSocketDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial, giving up if ctx is done before the handshake completes
+func (d *WebSocketDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	secure := false
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	hostport := u.Host
+	if u.Port() == "" {
+		if secure {
+			hostport = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			hostport = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var dialer Dialer = &net.Dialer{Timeout: d.Timeout}
+	if d.Dialer != nil {
+		dialer = d.Dialer
+	}
+	conn, err := dialContext(ctx, dialer, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	// Interrupt the handshakes if ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+
+	if secure {
+		config := &tls.Config{}
+		if d.TLSConfig != nil {
+			config = d.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			stop()
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	ws, err := wsHandshake(conn, u, d.Header)
+	if !stop() {
+		// Report the cancellation rather than the interrupted handshake
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var zero time.Time
+	conn.SetDeadline(zero)
+	return ws, nil
+}
+
+// UseWebSocket switches the connection to the WebSocket transport, using the given URL.
+// An empty URL uses DefaultWebSocketURL. TLS is handled by the WebSocketDialer for wss:// URLs,
+// so the Connection's own TLS option is turned off.
+func (tmi *Connection) UseWebSocket(rawurl string) {
+	if rawurl == "" {
+		rawurl = DefaultWebSocketURL
+	}
+	tmi.Dialer = &WebSocketDialer{
+		URL:       rawurl,
+		TLSConfig: tmi.TLSConfig,
+		Timeout:   tmi.Timeout,
+	}
+	tmi.TLS = false
+}
+
+// Perform the client side of the opening handshake on conn
+func wsHandshake(conn net.Conn, u *url.URL, header http.Header) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(res.Header.Get("Upgrade"), "websocket") ||
+		res.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, fmt.Errorf("websocket handshake failed: %s", res.Status)
+	}
+	return &wsConn{Conn: conn, br: br, client: true}, nil
+}
+
+// Compute the expected Sec-WebSocket-Accept value for a key
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsConn wraps an established WebSocket connection as a line-oriented net.Conn
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool   // Clients mask the frames they send, servers don't
+	buf    []byte // Unread payload of the current message
+	wmu    sync.Mutex
+	closed sync.Once
+}
+
+// Read reads the payload of incoming text and binary messages,
+// answering pings and ending with io.EOF when the peer closes
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsText, wsBinary, wsContinuation:
+			// Make sure every complete message reads as a line
+			if fin && !bytes.HasSuffix(payload, []byte{'\n'}) {
+				payload = append(payload, '\r', '\n')
+			}
+			c.buf = payload
+		case wsPing:
+			if err = c.writeFrame(wsPong, payload); err != nil {
+				return 0, err
+			}
+		case wsPong:
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write sends each line in p as its own text message, without the line ending
+func (c *wsConn) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(p, []byte{'\n'}) {
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			continue
+		}
+		if err := c.writeFrame(wsText, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close sends a normal closure frame, then closes the underlying connection
+func (c *wsConn) Close() error {
+	var err error
+	c.closed.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsClose, []byte{0x03, 0xE8}) // 1000, normal closure
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxFrameSize {
+		err = errors.New("websocket: frame too large")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode) // Always a single, final frame
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if !c.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
@@ -0,0 +1,185 @@
+package tmi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsServer upgrades requests to WebSocket, passing each connection on as a fakeServer
+func wsServer(t *testing.T, servers chan *fakeServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+			return
+		}
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		brw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+		brw.WriteString("Sec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		brw.Flush()
+		servers <- newFakeServer(&wsConn{Conn: c, br: brw.Reader})
+	})
+}
+
+func TestWebSocketDialer(t *testing.T) {
+	servers := make(chan *fakeServer, 1)
+	h := httptest.NewServer(wsServer(t, servers))
+	defer h.Close()
+
+	conn := New("sunsbot", "token")
+	conn.UseWebSocket("ws" + strings.TrimPrefix(h.URL, "http"))
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	server := <-servers
+
+	// Every line should arrive as its own message, without line endings
+	server.expect(t, "PASS oauth:token")
+	server.expect(t, "NICK sunsbot")
+
+	// Frames without line endings should still be read as lines
+	server.write(t, ":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :over websocket")
+	if m := readMessage(t, conn); m.Trailing != "over websocket" {
+		t.Errorf("unexpected message %v", m)
+	}
+	// Twitch sends several CRLF terminated lines in one frame
+	server.conn.(*wsConn).writeFrame(wsText, []byte(":a!a@a.tmi.twitch.tv PRIVMSG #sunspots :one\r\n:b!b@b.tmi.twitch.tv PRIVMSG #sunspots :two\r\n"))
+	for _, want := range []string{"one", "two"} {
+		if m := readMessage(t, conn); m.Trailing != want {
+			t.Errorf("expected %q, got %v", want, m)
+		}
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	servers := make(chan *fakeServer, 1)
+	h := httptest.NewTLSServer(wsServer(t, servers))
+	defer h.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(h.Certificate())
+	conn := New("sunsbot", "token")
+	conn.TLSConfig = &tls.Config{RootCAs: roots, ServerName: "example.com"}
+	conn.UseWebSocket("wss" + strings.TrimPrefix(h.URL, "https"))
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	server := <-servers
+	server.expect(t, "NICK sunsbot")
+	server.write(t, ":sunspots!sunspots@sunspots.tmi.twitch.tv PRIVMSG #sunspots :over wss")
+	if m := readMessage(t, conn); m.Trailing != "over wss" {
+		t.Errorf("unexpected message %v", m)
+	}
+}
+
+// Read n bytes from the raw end of a pipe
+func readBytes(t *testing.T, r io.Reader, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Read a masked frame header from the raw end of a pipe, check it and return the unmasked payload
+func readMasked(t *testing.T, r io.Reader, header []byte, length int) []byte {
+	t.Helper()
+	if h := readBytes(t, r, len(header)); !bytes.Equal(h, header) {
+		t.Fatalf("expected header % x, got % x", header, h)
+	}
+	mask := readBytes(t, r, 4)
+	payload := readBytes(t, r, length)
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return payload
+}
+
+// Frames checked byte for byte against RFC 6455, rather than against wsConn itself
+func TestWebSocketFrames(t *testing.T) {
+	raw, pipe := net.Pipe()
+	defer raw.Close()
+	client := &wsConn{Conn: pipe, br: bufio.NewReader(pipe), client: true}
+
+	// Client frames are masked, final text frames
+	go client.Write([]byte("PING x\r\n"))
+	if p := readMasked(t, raw, []byte{0x81, 0x80 | 6}, 6); string(p) != "PING x" {
+		t.Errorf("unexpected payload %q", p)
+	}
+
+	// 126 means a 16 bit extended length
+	long := strings.Repeat("a", 300)
+	go client.Write([]byte(long))
+	if p := readMasked(t, raw, []byte{0x81, 0x80 | 126, 0x01, 0x2C}, 300); string(p) != long {
+		t.Errorf("unexpected payload of %d bytes", len(p))
+	}
+
+	// Unmasked server frame with an extended length
+	go raw.Write(append([]byte{0x81, 126, 0x01, 0x2C}, long...))
+	if b := readBytes(t, client, 302); string(b) != long+"\r\n" {
+		t.Errorf("unexpected read of %d bytes", len(b))
+	}
+
+	// Pings are answered with a pong carrying the same payload
+	read := make(chan []byte)
+	go func() {
+		b := make([]byte, 10)
+		n, _ := client.Read(b)
+		read <- b[:n]
+	}()
+	raw.Write([]byte{0x89, 0x02, 'h', 'i'})
+	if p := readMasked(t, raw, []byte{0x8A, 0x80 | 2}, 2); string(p) != "hi" {
+		t.Errorf("unexpected pong payload %q", p)
+	}
+	raw.Write([]byte{0x81, 0x02, 'o', 'k'})
+	if b := <-read; string(b) != "ok\r\n" {
+		t.Errorf("unexpected read %q", b)
+	}
+
+	// A close frame is echoed, and ends reading
+	errs := make(chan error)
+	go func() {
+		_, err := client.Read(make([]byte, 10))
+		errs <- err
+	}()
+	raw.Write([]byte{0x88, 0x02, 0x03, 0xE8})
+	if p := readMasked(t, raw, []byte{0x88, 0x80 | 2}, 2); !bytes.Equal(p, []byte{0x03, 0xE8}) {
+		t.Errorf("unexpected close payload % x", p)
+	}
+	if err := <-errs; err != io.EOF {
+		t.Errorf("expected io.EOF after closing, got %v", err)
+	}
+}
+
+func TestWebSocketMaskedRead(t *testing.T) {
+	raw, pipe := net.Pipe()
+	defer raw.Close()
+	server := &wsConn{Conn: pipe, br: bufio.NewReader(pipe)}
+
+	// "Hello" masked with 37 fa 21 3d, the example from RFC 6455 section 5.7
+	go raw.Write([]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58})
+	if b := readBytes(t, server, 7); string(b) != "Hello\r\n" {
+		t.Errorf("unexpected read %q", b)
+	}
+
+	// Server frames aren't masked
+	go server.Write([]byte("Hello"))
+	if b := readBytes(t, raw, 7); !bytes.Equal(b, []byte{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'}) {
+		t.Errorf("unexpected frame % x", b)
+	}
+}